@@ -14,11 +14,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/containerd/cgroups/v3"
@@ -34,33 +40,138 @@ import (
 )
 
 var (
-	configPaths            = kingpin.Flag("config.paths", "Comma separated list of cgroup paths to check, eg /user.slice,/system.slice,/slurm").Required().String()
+	configFile             = kingpin.Flag("config.file", "Path to YAML configuration file").String()
+	configPaths            = kingpin.Flag("config.paths", "Comma separated list of cgroup paths to check, eg /user.slice,/system.slice,/slurm. Shorthand for a --config.file listing only paths").String()
+	enableLifecycle        = kingpin.Flag("web.enable-lifecycle", "Enable reloading the configuration via HTTP POST to /-/reload").Default("false").Bool()
 	disableExporterMetrics = kingpin.Flag("web.disable-exporter-metrics", "Exclude metrics about the exporter (promhttp_*, process_*, go_*)").Default("false").Bool()
+	scrapeTimeoutOffset    = kingpin.Flag("web.scrape-timeout-offset", "Offset to subtract from the Prometheus scrape timeout so partial results are returned in time").Default("500ms").Duration()
 )
 
-func metricsHandler(logger *slog.Logger) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		registry := prometheus.NewRegistry()
+// loadConfig returns the configuration from --config.file or --config.paths
+func loadConfig() (*collector.Config, error) {
+	if *configFile != "" && *configPaths != "" {
+		return nil, fmt.Errorf("only one of --config.file and --config.paths can be set")
+	}
+	if *configFile != "" {
+		return collector.LoadConfig(*configFile)
+	}
+	if *configPaths == "" {
+		return nil, fmt.Errorf("one of --config.file or --config.paths is required")
+	}
+	config := collector.ConfigFromPaths(strings.Split(*configPaths, ","))
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid --config.paths: %w", err)
+	}
+	return config, nil
+}
+
+// reloader swaps the collector configuration and records the result of the last reload
+type reloader struct {
+	collector     collector.Collector
+	logger        *slog.Logger
+	lock          sync.Mutex
+	reloadSuccess prometheus.Gauge
+	reloadTime    prometheus.Gauge
+}
 
-		paths := strings.Split(*configPaths, ",")
+func newReloader(cgroupCollector collector.Collector, logger *slog.Logger) *reloader {
+	r := &reloader{
+		collector: cgroupCollector,
+		logger:    logger,
+		reloadSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: fmt.Sprintf("%s_exporter", collector.Namespace),
+			Name:      "config_last_reload_successful",
+			Help:      "Whether the last configuration reload attempt was successful",
+		}),
+		reloadTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: fmt.Sprintf("%s_exporter", collector.Namespace),
+			Name:      "config_last_reload_success_timestamp_seconds",
+			Help:      "Timestamp of the last successful configuration load",
+		}),
+	}
+	// The configuration loaded at startup counts as the first successful load
+	r.reloadSuccess.Set(1)
+	r.reloadTime.SetToCurrentTime()
+	return r
+}
+
+// reload loads and validates the configuration, the running configuration is kept on error
+func (r *reloader) reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	config, err := loadConfig()
+	if err != nil {
+		r.logger.Error("Error reloading configuration", "err", err)
+		r.reloadSuccess.Set(0)
+		return err
+	}
+	r.collector.SetConfig(config)
+	r.reloadSuccess.Set(1)
+	r.reloadTime.SetToCurrentTime()
+	r.logger.Info("Reloaded configuration", "paths", len(config.Paths))
+	return nil
+}
+
+// handleSignals reloads the configuration on each SIGHUP received on hup
+func (r *reloader) handleSignals(hup <-chan os.Signal) {
+	for range hup {
+		//nolint:errcheck
+		r.reload()
+	}
+}
 
-		var cgroupV2 bool
-		if cgroups.Mode() == cgroups.Unified {
-			cgroupV2 = true
+func reloadHandler(r *reloader) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost && req.Method != http.MethodPut {
+			w.Header().Set("Allow", "POST, PUT")
+			http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+			return
 		}
-		cgroupCollector := collector.NewCgroupCollector(cgroupV2, paths, logger)
-		registry.MustRegister(cgroupCollector)
-		registry.MustRegister(versionCollector.NewCollector(fmt.Sprintf("%s_exporter", collector.Namespace)))
+		if err := r.reload(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+		}
+	})
+}
+
+func metricsHandler(config *collector.Config, logger *slog.Logger) (http.Handler, *reloader) {
+	var cgroupV2 bool
+	if cgroups.Mode() == cgroups.Unified {
+		cgroupV2 = true
+	}
+	// Collector and registry are shared between requests so the collector can keep state between scrapes
+	cgroupCollector := collector.NewCgroupCollector(cgroupV2, config, logger)
+	reload := newReloader(cgroupCollector, logger)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(versionCollector.NewCollector(fmt.Sprintf("%s_exporter", collector.Namespace)))
+	registry.MustRegister(reload.reloadSuccess, reload.reloadTime)
 
-		gatherers := prometheus.Gatherers{registry}
-		if !*disableExporterMetrics {
-			gatherers = append(gatherers, prometheus.DefaultGatherer)
+	gatherers := prometheus.Gatherers{registry}
+	if !*disableExporterMetrics {
+		gatherers = append(gatherers, prometheus.DefaultGatherer)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); header != "" {
+			timeoutSeconds, err := strconv.ParseFloat(header, 64)
+			if err != nil {
+				logger.Error("Failed to parse scrape timeout header", "timeout", header, "err", err)
+			} else if timeout := time.Duration(timeoutSeconds*float64(time.Second)) - *scrapeTimeoutOffset; timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
 		}
+		// Registry.Gather and promhttp take no context, so the scrape timeout reaches the cgroup collector through a
+		// registry built for this request. It only holds the context bound wrapper, the collector and the state it
+		// keeps between scrapes stay shared, at the cost of registering one collector and a handler per scrape.
+		scrapeRegistry := prometheus.NewRegistry()
+		scrapeRegistry.MustRegister(cgroupCollector.WithContext(ctx))
 
 		// Delegate http serving to Prometheus client library, which will call collector.Collect.
-		h := promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{})
+		h := promhttp.HandlerFor(append(prometheus.Gatherers{scrapeRegistry}, gatherers...), promhttp.HandlerOpts{})
 		h.ServeHTTP(w, r)
-	}
+	}), reload
 }
 
 func main() {
@@ -73,6 +184,10 @@ func main() {
 	kingpin.HelpFlag.Short('h')
 	kingpin.Parse()
 
+	// Registered before anything else so an early SIGHUP is queued instead of terminating the exporter
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
 	logger := promslog.New(promslogConfig)
 	logger.Info("Starting cgroup_exporter", "version", version.Info())
 	logger.Info("Build context", "build_context", version.BuildContext())
@@ -87,7 +202,17 @@ func main() {
              </body>
              </html>`))
 	})
-	http.Handle(metricsEndpoint, metricsHandler(logger))
+	config, err := loadConfig()
+	if err != nil {
+		logger.Error("Error loading configuration", "err", err)
+		os.Exit(1)
+	}
+	handler, reload := metricsHandler(config, logger)
+	http.Handle(metricsEndpoint, handler)
+	if *enableLifecycle {
+		http.Handle("/-/reload", reloadHandler(reload))
+	}
+	go reload.handleSignals(hup)
 
 	server := &http.Server{}
 	if err := web.ListenAndServe(server, toolkitFlags, logger); err != nil {
@@ -17,6 +17,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -26,7 +27,6 @@ import (
 
 	kingpin "github.com/alecthomas/kingpin/v2"
 	"github.com/prometheus/common/promslog"
-	"github.com/treydock/cgroup_exporter/collector"
 )
 
 const (
@@ -38,12 +38,6 @@ func TestMain(m *testing.M) {
 	dir := filepath.Dir(filename)
 	fixture := filepath.Join(dir, "fixtures")
 	procFixture := filepath.Join(fixture, "proc")
-	collector.PidGroupPath = func(pid int) (string, error) {
-		if pid == 67998 {
-			return "/user.slice/user-20821.slice/session-157.scope", nil
-		}
-		return "", fmt.Errorf("Could not find cgroup path for %d", pid)
-	}
 	args := []string{
 		"--config.paths=/user.slice",
 		fmt.Sprintf("--path.cgroup.root=%s", fixture),
@@ -57,8 +51,14 @@ func TestMain(m *testing.M) {
 	level := promslog.NewLevel()
 	level.Set("debug")
 	logger := promslog.New(&promslog.Config{Level: level})
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Printf("Error: %s", err.Error())
+		os.Exit(1)
+	}
 	go func() {
-		http.Handle("/metrics", metricsHandler(logger))
+		handler, _ := metricsHandler(config, logger)
+		http.Handle("/metrics", handler)
 		err := http.ListenAndServe(address, nil)
 		if err != nil {
 			fmt.Printf("Error: %s", err.Error())
@@ -80,18 +80,171 @@ func TestMetricsHandler(t *testing.T) {
 	if !strings.Contains(body, "cgroup_memory_used_bytes{cgroup=\"/user.slice/user-20821.slice\"} 2.711552e+07") {
 		t.Errorf("Unexpected value for cgroup_memory_used_bytes: %s", body)
 	}
+	if !strings.Contains(body, "cgroup_exporter_collect_error{cgroup=\"/user.slice/user-20821.slice\"} 0") {
+		t.Errorf("Unexpected value for cgroup_exporter_collect_error: %s", body)
+	}
+	// Registry is reused between requests
+	body, err = queryExporter()
+	if err != nil {
+		t.Fatalf("Unexpected error on second GET /metrics: %s", err.Error())
+	}
+	if !strings.Contains(body, "cgroup_memory_used_bytes{cgroup=\"/user.slice/user-20821.slice\"} 2.711552e+07") {
+		t.Errorf("Unexpected value for cgroup_memory_used_bytes on second scrape: %s", body)
+	}
 }
 
 func TestMetricsHandlerBadPath(t *testing.T) {
 	cPath := "/dne"
 	configPaths = &cPath
-	body, err := queryExporter()
+	config, err := loadConfig()
 	if err != nil {
-		t.Fatalf("Unexpected error GET /metrics: %s", err.Error())
+		t.Fatalf("Unexpected error loading config: %s", err)
 	}
+	handler, _ := metricsHandler(config, promslog.NewNopLogger())
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if want, have := http.StatusOK, rec.Code; want != have {
+		t.Fatalf("want /metrics status code %d, have %d", want, have)
+	}
+	body := rec.Body.String()
 	if !strings.Contains(body, "cgroup_exporter_collect_error{cgroup=\"/dne\"} 1") {
 		t.Errorf("Unexpected value for cgroup_exporter_collect_error: %s", body)
 	}
+	if !strings.Contains(body, "cgroup_exporter_collect_errors_total{reason=\"load_failed\"} 1") {
+		t.Errorf("Unexpected value for cgroup_exporter_collect_errors_total: %s", body)
+	}
+}
+
+func TestMetricsHandlerScrapeTimeout(t *testing.T) {
+	cPath := "/user.slice"
+	configPaths = &cPath
+	offset := time.Duration(0)
+	scrapeTimeoutOffset = &offset
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatalf("Unexpected error loading config: %s", err)
+	}
+	handler, _ := metricsHandler(config, promslog.NewNopLogger())
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "0.000000001")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if want, have := http.StatusOK, rec.Code; want != have {
+		t.Fatalf("want /metrics status code %d, have %d", want, have)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "cgroup_exporter_collect_error{cgroup=\"/user.slice\"} 1") {
+		t.Errorf("Unexpected value for cgroup_exporter_collect_error: %s", body)
+	}
+	if !strings.Contains(body, "cgroup_exporter_collect_errors_total{reason=\"timeout\"} 1") {
+		t.Errorf("Unexpected value for cgroup_exporter_collect_errors_total: %s", body)
+	}
+	// Cgroups that timed out only report the collect error
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "cgroup_cpu") || strings.HasPrefix(line, "cgroup_memory") {
+			t.Errorf("Unexpected metric for timed out cgroup: %s", line)
+		}
+	}
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "foo")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	body = rec.Body.String()
+	if !strings.Contains(body, "cgroup_exporter_collect_error{cgroup=\"/user.slice/user-20821.slice\"} 0") {
+		t.Errorf("Unexpected collect error with invalid timeout header: %s", body)
+	}
+	if !strings.Contains(body, "cgroup_memory_used_bytes{cgroup=\"/user.slice/user-20821.slice\"} 2.711552e+07") {
+		t.Errorf("Unexpected value for cgroup_memory_used_bytes: %s", body)
+	}
+}
+
+func TestReload(t *testing.T) {
+	cPath := "/dne"
+	configPaths = &cPath
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatalf("Unexpected error loading config: %s", err)
+	}
+	handler, reload := metricsHandler(config, promslog.NewNopLogger())
+	reloadH := reloadHandler(reload)
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return rec.Body.String()
+	}
+	body := scrape()
+	if !strings.Contains(body, "cgroup_exporter_config_last_reload_successful 1") {
+		t.Errorf("Unexpected value for cgroup_exporter_config_last_reload_successful: %s", body)
+	}
+	if !strings.Contains(body, "cgroup_exporter_config_last_reload_success_timestamp_seconds") {
+		t.Errorf("Missing cgroup_exporter_config_last_reload_success_timestamp_seconds: %s", body)
+	}
+
+	rec := httptest.NewRecorder()
+	reloadH.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/-/reload", nil))
+	if want, have := http.StatusMethodNotAllowed, rec.Code; want != have {
+		t.Errorf("want GET /-/reload status code %d, have %d", want, have)
+	}
+
+	cPath = "/user.slice"
+	rec = httptest.NewRecorder()
+	reloadH.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+	if want, have := http.StatusOK, rec.Code; want != have {
+		t.Fatalf("want POST /-/reload status code %d, have %d: %s", want, have, rec.Body.String())
+	}
+	body = scrape()
+	if !strings.Contains(body, "cgroup_memory_used_bytes{cgroup=\"/user.slice/user-20821.slice\"} 2.711552e+07") {
+		t.Errorf("Unexpected value for cgroup_memory_used_bytes after reload: %s", body)
+	}
+	if strings.Contains(body, "cgroup=\"/dne\"") {
+		t.Errorf("Unexpected metrics for removed path after reload: %s", body)
+	}
+
+	// Invalid configuration keeps the running configuration
+	cPath = "relative"
+	rec = httptest.NewRecorder()
+	reloadH.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+	if want, have := http.StatusInternalServerError, rec.Code; want != have {
+		t.Errorf("want POST /-/reload status code %d, have %d", want, have)
+	}
+	body = scrape()
+	if !strings.Contains(body, "cgroup_exporter_config_last_reload_successful 0") {
+		t.Errorf("Unexpected value for cgroup_exporter_config_last_reload_successful: %s", body)
+	}
+	if !strings.Contains(body, "cgroup_memory_used_bytes{cgroup=\"/user.slice/user-20821.slice\"} 2.711552e+07") {
+		t.Errorf("Unexpected value for cgroup_memory_used_bytes after failed reload: %s", body)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	cPath := "/user.slice"
+	configPaths = &cPath
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte("paths:\n  - path: /slurm\n    proc: true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configFile = &file
+	if _, err := loadConfig(); err == nil {
+		t.Errorf("Expected error when both --config.file and --config.paths are set")
+	}
+	empty := ""
+	configPaths = &empty
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if val := config.Paths[0].Path; val != "/slurm" {
+		t.Errorf("Unexpected path, got %s", val)
+	}
+	configFile = &empty
+	if _, err := loadConfig(); err == nil {
+		t.Errorf("Expected error when no paths are configured")
+	}
+	cPath = "/user.slice,relative"
+	configPaths = &cPath
+	if _, err := loadConfig(); err == nil {
+		t.Errorf("Expected error with relative path")
+	}
 }
 
 func queryExporter() (string, error) {
@@ -14,29 +14,54 @@
 package collector
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"log/slog"
+	"math"
+	"os"
 	"os/user"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/containerd/cgroups/v3/cgroup1"
 )
 
-func NewCgroupV1Collector(paths []string, logger *slog.Logger) Collector {
-	return NewExporter(paths, logger, false)
+func NewCgroupV1Collector(config *Config, logger *slog.Logger) *Exporter {
+	return NewExporter(config, logger, false)
 }
 
 func subsystem() ([]cgroup1.Subsystem, error) {
 	s := []cgroup1.Subsystem{
+		cgroup1.NewCpu(*CgroupRoot),
 		cgroup1.NewCpuacct(*CgroupRoot),
 		cgroup1.NewMemory(*CgroupRoot),
+		cgroup1.NewPids(*CgroupRoot),
 	}
 	return s, nil
 }
 
+// hierarchyv1 returns the subsystems read for the metric groups of a path, cpuacct is always read
+func hierarchyv1(p *PathConfig) cgroup1.Hierarchy {
+	return func() ([]cgroup1.Subsystem, error) {
+		s := []cgroup1.Subsystem{cgroup1.NewCpuacct(*CgroupRoot)}
+		if p.collects(groupCPU) {
+			s = append(s, cgroup1.NewCpu(*CgroupRoot))
+		}
+		if p.collects(groupMemory) {
+			s = append(s, cgroup1.NewMemory(*CgroupRoot))
+		}
+		if p.collects(groupPids) {
+			s = append(s, cgroup1.NewPids(*CgroupRoot))
+		}
+		return s, nil
+	}
+}
+
 func getInfov1(name string, metric *CgroupMetric, logger *slog.Logger) {
 	pathBase := filepath.Base(name)
 	userSlicePattern := regexp.MustCompile("^user-([0-9]+).slice$")
@@ -74,10 +99,16 @@ func getInfov1(name string, metric *CgroupMetric, logger *slog.Logger) {
 	}
 }
 
-func getNamev1(p cgroup1.Process, logger *slog.Logger) (string, error) {
+func getNamev1(p cgroup1.Process, pc *PathConfig, logger *slog.Logger) (string, error) {
 	cpuacctPath := filepath.Join(*CgroupRoot, "cpuacct")
-	name := strings.TrimPrefix(p.Path, cpuacctPath)
+	name, ok := strings.CutPrefix(p.Path, cpuacctPath)
+	if !ok {
+		return "", fmt.Errorf("process path %s is not under %s", p.Path, cpuacctPath)
+	}
 	name = strings.TrimSuffix(name, "/")
+	if aggregated, ok := pc.aggregate(name, pc.group(false)); ok {
+		return aggregated, nil
+	}
 	dirs := strings.Split(name, "/")
 	logger.Debug("cgroup name", "dirs", fmt.Sprintf("%v", dirs))
 	// Handle user.slice, system.slice and torque
@@ -99,24 +130,195 @@ func getNamev1(p cgroup1.Process, logger *slog.Logger) (string, error) {
 	return name, nil
 }
 
-func (e *Exporter) getMetricsv1(name string, pids map[string][]int) (CgroupMetric, error) {
-	metric := CgroupMetric{name: name}
+// getPidsMaxv1 returns the pids limit of a cgroup, -1 when there is no limit
+func getPidsMaxv1(name string) (float64, error) {
+	pidsMax, err := getValue(filepath.Join(*CgroupRoot, "pids", name, "pids.max"))
+	if err != nil {
+		return -1, err
+	}
+	if pidsMax == math.MaxUint64 {
+		return -1, nil
+	}
+	return pidsMax, nil
+}
+
+// getCFSv1 returns the CFS quota and period in seconds and the number of CPUs the quota allows
+func getCFSv1(name string) (float64, float64, float64, error) {
+	cpuPath := filepath.Join(*CgroupRoot, "cpu", name)
+	quotaData, err := os.ReadFile(filepath.Join(cpuPath, "cpu.cfs_quota_us"))
+	if err != nil {
+		return -1, 0, -1, err
+	}
+	quota, err := strconv.ParseInt(strings.TrimSpace(string(quotaData)), 10, 64)
+	if err != nil {
+		return -1, 0, -1, err
+	}
+	periodData, err := os.ReadFile(filepath.Join(cpuPath, "cpu.cfs_period_us"))
+	if err != nil {
+		return -1, 0, -1, err
+	}
+	period, err := strconv.ParseUint(strings.TrimSpace(string(periodData)), 10, 64)
+	if err != nil {
+		return -1, 0, -1, err
+	}
+	// A quota of -1 means no limit
+	if quota < 0 {
+		return -1, float64(period) / 1000000.0, -1, nil
+	}
+	return float64(quota) / 1000000.0, float64(period) / 1000000.0, getQuotaCores(quota, period), nil
+}
+
+func getBlkioStatv1(path string) (map[string]map[string]float64, error) {
+	stats := make(map[string]map[string]float64)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		parts := strings.Fields(s.Text())
+		// Final line is the total across all devices
+		if len(parts) == 2 && parts[0] == "Total" {
+			continue
+		}
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid format in %s", path)
+		}
+		v, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := stats[parts[0]]; !ok {
+			stats[parts[0]] = make(map[string]float64)
+		}
+		stats[parts[0]][parts[1]] = float64(v)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func getIOv1(name string) ([]ioStat, error) {
+	var io []ioStat
+	blkioPath := filepath.Join(*CgroupRoot, "blkio", name)
+	bytes, err := getBlkioStatv1(filepath.Join(blkioPath, "blkio.throttle.io_service_bytes"))
+	if err != nil {
+		return nil, err
+	}
+	ops, err := getBlkioStatv1(filepath.Join(blkioPath, "blkio.throttle.io_serviced"))
+	if err != nil {
+		return nil, err
+	}
+	var devices []string
+	for device := range bytes {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	for _, device := range devices {
+		io = append(io, ioStat{
+			device:     getBlockDevice(device),
+			readBytes:  bytes[device]["Read"],
+			writeBytes: bytes[device]["Write"],
+			readOps:    ops[device]["Read"],
+			writeOps:   ops[device]["Write"],
+		})
+	}
+	return io, nil
+}
+
+func getHugetlbv1(name string) ([]hugetlbStat, error) {
+	var hugetlb []hugetlbStat
+	hugetlbPath := filepath.Join(*CgroupRoot, "hugetlb", name)
+	for _, pagesize := range getHugetlbPageSizes(hugetlbPath, "usage_in_bytes") {
+		prefix := filepath.Join(hugetlbPath, fmt.Sprintf("hugetlb.%s", pagesize))
+		usage, err := getValue(prefix + ".usage_in_bytes")
+		if err != nil {
+			return nil, err
+		}
+		limit, err := getValue(prefix + ".limit_in_bytes")
+		if err != nil {
+			return nil, err
+		}
+		failcnt, err := getValue(prefix + ".failcnt")
+		if err != nil {
+			return nil, err
+		}
+		hugetlb = append(hugetlb, hugetlbStat{pagesize: pagesize, usage: usage, limit: limit, failcnt: failcnt})
+	}
+	return hugetlb, nil
+}
+
+func getNumaStatv1(path string) ([]numaStat, error) {
+	var numa, hierarchical []numaStat
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	pageSize := float64(os.Getpagesize())
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		parts := strings.Fields(s.Text())
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("invalid format in %s", path)
+		}
+		kind := strings.SplitN(parts[0], "=", 2)[0]
+		for _, field := range parts[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 || !strings.HasPrefix(kv[0], "N") {
+				return nil, fmt.Errorf("invalid format in %s", path)
+			}
+			pages, err := strconv.ParseUint(kv[1], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			// memory.numa_stat values are in pages
+			stat := numaStat{node: strings.TrimPrefix(kv[0], "N"), kind: kind, bytes: float64(pages) * pageSize}
+			if strings.HasPrefix(kind, "hierarchical_") {
+				stat.kind = strings.TrimPrefix(kind, "hierarchical_")
+				hierarchical = append(hierarchical, stat)
+			} else {
+				numa = append(numa, stat)
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	// Prefer hierarchical values to match how other memory metrics are reported
+	if hierarchical != nil {
+		return hierarchical, nil
+	}
+	return numa, nil
+}
+
+func (e *Exporter) getMetricsv1(ctx context.Context, p *PathConfig, name string, pids map[string][]int) (CgroupMetric, error) {
+	metric := CgroupMetric{name: name, cpuQuota: -1, cpuQuotaCores: -1, memoryValues: make(map[string]float64)}
+	release, err := e.pool.acquire(ctx)
+	if err != nil {
+		e.logger.Error("Timeout waiting for worker", "path", name, "err", err)
+		metric.setFailed(reasonTimeout)
+		return metric, err
+	}
+	defer release()
 	e.logger.Debug("Loading cgroup", "root", *CgroupRoot, "path", name)
-	ctrl, err := cgroup1.Load(cgroup1.StaticPath(name), cgroup1.WithHierarchy(subsystem))
+	ctrl, err := cgroup1.Load(cgroup1.StaticPath(name), cgroup1.WithHierarchy(hierarchyv1(p)))
 	if err != nil {
 		e.logger.Error("Failed to load cgroups", "path", name, "err", err)
-		metric.err = true
+		metric.setFailed(reasonLoadFailed)
 		return metric, err
 	}
 	stats, err := ctrl.Stat(cgroup1.IgnoreNotExist)
 	if err != nil {
 		e.logger.Error("Failed to stat cgroups", "path", name, "err", err)
-		metric.err = true
+		metric.setFailed(reasonStatFailed)
 		return metric, err
 	}
 	if stats == nil {
 		e.logger.Error("Cgroup stats are nil", "path", name)
-		metric.err = true
+		metric.setFailed(reasonStatFailed)
 		return metric, err
 	}
 	if stats.CPU != nil {
@@ -125,6 +327,14 @@ func (e *Exporter) getMetricsv1(name string, pids map[string][]int) (CgroupMetri
 			metric.cpuSystem = float64(stats.CPU.Usage.Kernel) / 1000000000.0
 			metric.cpuTotal = float64(stats.CPU.Usage.Total) / 1000000000.0
 		}
+		if stats.CPU.Throttling != nil {
+			metric.cpuPeriods = float64(stats.CPU.Throttling.Periods)
+			metric.cpuThrottled = float64(stats.CPU.Throttling.ThrottledPeriods)
+			metric.cpuThrottledSec = float64(stats.CPU.Throttling.ThrottledTime) / 1000000000.0
+		}
+	}
+	if p.collects(groupCPU) {
+		e.getCPUv1(name, &metric)
 	}
 	if stats.Memory != nil {
 		metric.memoryRSS = float64(stats.Memory.TotalRSS)
@@ -133,6 +343,7 @@ func (e *Exporter) getMetricsv1(name string, pids map[string][]int) (CgroupMetri
 			metric.memoryUsed = float64(stats.Memory.Usage.Usage)
 			metric.memoryTotal = float64(stats.Memory.Usage.Limit)
 			metric.memoryFailCount = float64(stats.Memory.Usage.Failcnt)
+			metric.memoryValues["peak"] = float64(stats.Memory.Usage.Max)
 		}
 		if stats.Memory.Swap != nil {
 			metric.memswUsed = float64(stats.Memory.Swap.Usage)
@@ -140,76 +351,160 @@ func (e *Exporter) getMetricsv1(name string, pids map[string][]int) (CgroupMetri
 			metric.memswFailCount = float64(stats.Memory.Swap.Failcnt)
 		}
 	}
-	cpusPath := fmt.Sprintf("%s/cpuset%s/cpuset.cpus", *CgroupRoot, name)
-	if cpus, err := getCPUs(cpusPath, e.logger); err == nil {
-		metric.cpus = len(cpus)
-		metric.cpu_list = strings.Join(cpus, ",")
+	if p.collects(groupMemory) {
+		e.getMemoryv1(name, &metric)
+	}
+	if stats.Pids != nil {
+		metric.pids = true
+		metric.pidsCurrent = float64(stats.Pids.Current)
+		// The cgroup1 library returns 0 for both a limit of 0 and max so pids.max is read directly
+		if pidsMax, err := getPidsMaxv1(name); err == nil {
+			metric.pidsMax = pidsMax
+		} else {
+			metric.pidsMax = -1
+			e.logger.Debug("Unable to get pids.max", "path", name, "err", err)
+		}
+		pidsEventsPath := filepath.Join(*CgroupRoot, "pids", name, "pids.events")
+		if pidsEvents, err := parseStatFile(pidsEventsPath); err == nil {
+			metric.pidsEventsMax = pidsEvents["max"]
+		} else {
+			e.logger.Debug("Unable to get pids.events", "path", name, "err", err)
+		}
+	}
+	if p.collects(groupHugetlb) {
+		if hugetlb, err := getHugetlbv1(name); err == nil {
+			metric.hugetlb = hugetlb
+		} else {
+			e.logger.Error("Unable to get hugetlb stats", "path", name, "err", err)
+		}
+	}
+	if p.collects(groupIO) {
+		if io, err := getIOv1(name); err == nil {
+			metric.io = io
+		} else {
+			e.logger.Debug("Unable to get blkio stats", "path", name, "err", err)
+		}
+	}
+	if p.collects(groupNuma) {
+		numaStatPath := filepath.Join(*CgroupRoot, "memory", name, "memory.numa_stat")
+		if numa, err := getNumaStatv1(numaStatPath); err == nil {
+			metric.numa = e.filterNumaStat(numa)
+		} else {
+			e.logger.Debug("Unable to get memory.numa_stat", "path", name, "err", err)
+		}
 	}
 	getInfov1(name, &metric, e.logger)
-	if *collectProc {
+	// Process info acquires a worker per PID
+	release()
+	if p.proc() {
 		if val, ok := pids[name]; ok {
 			e.logger.Debug("Get process info", "pids", fmt.Sprintf("%v", val))
-			getProcInfo(val, &metric, e.logger)
+			getProcInfo(ctx, e.pool, val, &metric, e.logger)
 		} else {
 			e.logger.Error("Unable to get PIDs", "path", name)
-			metric.err = true
+			metric.setError(reasonPidsUnavailable)
 		}
 	}
 	return metric, nil
 }
 
-func (e *Exporter) collectv1() ([]CgroupMetric, error) {
+// getCPUv1 reads the CFS quota and cpuset of a cgroup
+func (e *Exporter) getCPUv1(name string, metric *CgroupMetric) {
+	if quota, period, cores, err := getCFSv1(name); err == nil {
+		metric.cpuQuota = quota
+		metric.cpuPeriod = period
+		metric.cpuQuotaCores = cores
+	} else {
+		e.logger.Debug("Unable to get CFS quota", "path", name, "err", err)
+	}
+	cpusPath := fmt.Sprintf("%s/cpuset%s/cpuset.cpus", *CgroupRoot, name)
+	if cpus, err := getCPUs(cpusPath, e.logger); err == nil {
+		metric.cpus = len(cpus)
+		metric.cpu_list = strings.Join(cpus, ",")
+	}
+	effectiveCpusPath := fmt.Sprintf("%s/cpuset%s/cpuset.effective_cpus", *CgroupRoot, name)
+	if cpus, err := getCPUs(effectiveCpusPath, e.logger); err == nil {
+		metric.cpusEffective = len(cpus)
+		metric.cpu_effective = strings.Join(cpus, ",")
+	}
+	memsPath := fmt.Sprintf("%s/cpuset%s/cpuset.mems", *CgroupRoot, name)
+	if mems, err := getCPUs(memsPath, e.logger); err == nil {
+		metric.mems_list = strings.Join(mems, ",")
+	}
+}
+
+// getMemoryv1 reads the memory soft limit and memory.stat of a cgroup
+func (e *Exporter) getMemoryv1(name string, metric *CgroupMetric) {
+	// soft_limit_in_bytes is the cgroup v1 equivalent of memory.low
+	softLimitPath := filepath.Join(*CgroupRoot, "memory", name, "memory.soft_limit_in_bytes")
+	if softLimit, err := getValue(softLimitPath); err == nil {
+		metric.memoryValues["low"] = softLimit
+	} else {
+		e.logger.Debug("Unable to get memory soft limit", "path", name, "err", err)
+	}
+	memoryStatPath := filepath.Join(*CgroupRoot, "memory", name, "memory.stat")
+	if memoryStat, err := parseStatFile(memoryStatPath); err == nil {
+		metric.memoryStat = e.filterMemoryStat(memoryStat)
+	} else {
+		e.logger.Debug("Unable to get memory.stat", "path", name, "err", err)
+	}
+}
+
+func (e *Exporter) collectv1(ctx context.Context) ([]CgroupMetric, []pathStat, error) {
 	var metrics []CgroupMetric
-	for _, path := range e.paths {
-		var names []string
-		e.logger.Debug("Loading cgroup", "root", *CgroupRoot, "path", path)
-		control, err := cgroup1.Load(cgroup1.StaticPath(path), cgroup1.WithHierarchy(subsystem))
-		if err != nil {
-			e.logger.Error("Error loading cgroup subsystem", "root", *CgroupRoot, "path", path, "err", err)
-			metric := CgroupMetric{name: path, err: true}
-			metrics = append(metrics, metric)
-			continue
-		}
-		processes, err := control.Processes(cgroup1.Cpuacct, true)
+	var stats []pathStat
+	paths := e.expandPaths(e.getPaths())
+	for i := range paths {
+		start := time.Now()
+		pathMetrics, stat := e.collectPathv1(ctx, &paths[i])
+		stat.duration = time.Since(start).Seconds()
+		metrics = append(metrics, pathMetrics...)
+		stats = append(stats, stat)
+	}
+	return metrics, stats, nil
+}
+
+func (e *Exporter) collectPathv1(ctx context.Context, pc *PathConfig) ([]CgroupMetric, pathStat) {
+	path := pc.Path
+	group := pc.group(false)
+	stat := pathStat{path: path}
+	if ctx.Err() != nil {
+		e.logger.Error("Timeout before loading cgroup", "path", path, "err", ctx.Err())
+		return []CgroupMetric{pathError(path, reasonTimeout)}, stat
+	}
+	e.logger.Debug("Loading cgroup", "root", *CgroupRoot, "path", path, "group", group)
+	control, err := cgroup1.Load(cgroup1.StaticPath(group), cgroup1.WithHierarchy(subsystem))
+	if err != nil {
+		e.logger.Error("Error loading cgroup subsystem", "root", *CgroupRoot, "path", path, "err", err)
+		return []CgroupMetric{pathError(path, reasonLoadFailed)}, stat
+	}
+	processes, err := control.Processes(cgroup1.Cpuacct, true)
+	if err != nil {
+		e.logger.Error("Error loading cgroup processes", "path", path, "err", err)
+		return []CgroupMetric{pathError(path, reasonLoadFailed)}, stat
+	}
+	e.logger.Debug("Found processes", "processes", len(processes))
+	stat.processes = len(processes)
+	index := newPidIndex()
+	for _, p := range processes {
+		e.logger.Debug("Get Name", "process", p.Path, "pid", p.Pid, "path", path)
+		name, err := getNamev1(p, pc, e.logger)
 		if err != nil {
-			e.logger.Error("Error loading cgroup processes", "path", path, "err", err)
-			metric := CgroupMetric{name: path, err: true}
-			metrics = append(metrics, metric)
+			e.logger.Error("Error getting cgroup name for process", "process", p.Path, "path", path, "err", err)
+			stat.pidErrors++
 			continue
 		}
-		e.logger.Debug("Found processes", "processes", len(processes))
-		pids := make(map[string][]int)
-		for _, p := range processes {
-			e.logger.Debug("Get Name", "process", p.Path, "pid", p.Pid, "path", path)
-			name, err := getNamev1(p, e.logger)
-			if err != nil {
-				e.logger.Error("Error getting cgroup name for process", "process", p.Path, "path", path, "err", err)
-				continue
-			}
-			if !sliceContains(names, name) {
-				names = append(names, name)
-			}
-			if val, ok := pids[name]; ok {
-				if !sliceContains(val, p.Pid) {
-					val = append(val, p.Pid)
-				}
-				pids[name] = val
-			} else {
-				pids[name] = []int{p.Pid}
-			}
-		}
-		wg := &sync.WaitGroup{}
-		wg.Add(len(names))
-		for _, name := range names {
-			go func(n string, p map[string][]int) {
-				defer wg.Done()
-				metric, _ := e.getMetricsv1(n, p)
-				metricLock.Lock()
-				metrics = append(metrics, metric)
-				metricLock.Unlock()
-			}(name, pids)
-		}
-		wg.Wait()
+		index.add(name, p.Pid)
+	}
+	names := pc.filter(index.names)
+	if len(names) != len(index.names) {
+		e.logger.Debug("Filtered cgroups", "path", path, "cgroups", len(index.names), "collected", len(names))
 	}
-	return metrics, nil
+	stat.cgroups = len(index.names)
+	metrics := e.getMetrics(ctx, names, func(n string) (CgroupMetric, bool) {
+		metric, _ := e.getMetricsv1(ctx, pc, n, index.pids)
+		return metric, true
+	})
+	pc.apply(metrics)
+	return metrics, stat
 }
@@ -14,8 +14,12 @@
 package collector
 
 import (
+	"context"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/containerd/cgroups/v3/cgroup1"
 	"github.com/prometheus/common/promslog"
 )
 
@@ -25,8 +29,8 @@ func TestCollectUserSlice(t *testing.T) {
 	level := promslog.NewLevel()
 	level.Set("debug")
 	logger := promslog.New(&promslog.Config{Level: level})
-	exporter := NewExporter([]string{"/user.slice"}, logger, false)
-	metrics, err := exporter.collectv1()
+	exporter := NewExporter(ConfigFromPaths([]string{"/user.slice"}), logger, false)
+	metrics, _, err := exporter.collectv1(context.Background())
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err.Error())
 		return
@@ -47,6 +51,21 @@ func TestCollectUserSlice(t *testing.T) {
 	if val := metrics[0].cpus; val != 0 {
 		t.Errorf("Unexpected value for cpus, got %v", val)
 	}
+	if val := metrics[0].cpuPeriods; val != 108 {
+		t.Errorf("Unexpected value for cpuPeriods, got %v", val)
+	}
+	if val := metrics[0].cpuThrottled; val != 0 {
+		t.Errorf("Unexpected value for cpuThrottled, got %v", val)
+	}
+	if val := metrics[0].cpuQuota; val != 0.7 {
+		t.Errorf("Unexpected value for cpuQuota, got %v", val)
+	}
+	if val := metrics[0].cpuPeriod; val != 0.1 {
+		t.Errorf("Unexpected value for cpuPeriod, got %v", val)
+	}
+	if val := metrics[0].cpuQuotaCores; val != 7 {
+		t.Errorf("Unexpected value for cpuQuotaCores, got %v", val)
+	}
 	if val := metrics[0].memoryRSS; val != 5378048 {
 		t.Errorf("Unexpected value for memoryRSS, got %v", val)
 	}
@@ -71,11 +90,59 @@ func TestCollectUserSlice(t *testing.T) {
 	if val := metrics[0].memswFailCount; val != 0 {
 		t.Errorf("Unexpected value for swapFailCount, got %v", val)
 	}
+	if val := metrics[0].pids; val != false {
+		t.Errorf("Unexpected value for pids, got %v", val)
+	}
 	if val := metrics[0].uid; val != "20821" {
 		t.Errorf("Unexpected value for uid, got %v", val)
 	}
 }
 
+func TestGetNamev1(t *testing.T) {
+	pc := &PathConfig{Path: "/slurm"}
+	logger := promslog.NewNopLogger()
+	p := cgroup1.Process{Path: filepath.Join(*CgroupRoot, "cpuacct", "slurm/uid_20821/job_10/step_batch")}
+	name, err := getNamev1(p, pc, logger)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if name != "/slurm/uid_20821/job_10" {
+		t.Errorf("Unexpected name, got %s", name)
+	}
+	p = cgroup1.Process{Path: filepath.Join(*CgroupRoot, "memory", "slurm/uid_20821/job_10")}
+	if _, err := getNamev1(p, pc, logger); err == nil {
+		t.Errorf("Expected error with process outside cpuacct but none given")
+	}
+}
+
+func TestGetPidsMaxv1(t *testing.T) {
+	root := t.TempDir()
+	for name, value := range map[string]string{"frozen": "0", "unlimited": "max", "limited": "512"} {
+		dir := filepath.Join(root, "pids", name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "pids.max"), []byte(value+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cgroupRoot := *CgroupRoot
+	CgroupRoot = &root
+	defer func() { CgroupRoot = &cgroupRoot }()
+	if val, err := getPidsMaxv1("/frozen"); err != nil || val != 0 {
+		t.Errorf("Unexpected value for frozen pids.max, got %v err %v", val, err)
+	}
+	if val, err := getPidsMaxv1("/unlimited"); err != nil || val != -1 {
+		t.Errorf("Unexpected value for unlimited pids.max, got %v err %v", val, err)
+	}
+	if val, err := getPidsMaxv1("/limited"); err != nil || val != 512 {
+		t.Errorf("Unexpected value for limited pids.max, got %v err %v", val, err)
+	}
+	if _, err := getPidsMaxv1("/dne"); err == nil {
+		t.Errorf("Expected error with /dne but none given")
+	}
+}
+
 func TestCollectSLURM(t *testing.T) {
 	varTrue := true
 	collectProc = &varTrue
@@ -84,8 +151,8 @@ func TestCollectSLURM(t *testing.T) {
 	level := promslog.NewLevel()
 	level.Set("debug")
 	logger := promslog.New(&promslog.Config{Level: level})
-	exporter := NewExporter([]string{"/slurm"}, logger, false)
-	metrics, err := exporter.collectv1()
+	exporter := NewExporter(ConfigFromPaths([]string{"/slurm"}), logger, false)
+	metrics, stats, err := exporter.collectv1(context.Background())
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err.Error())
 		return
@@ -94,6 +161,18 @@ func TestCollectSLURM(t *testing.T) {
 		t.Errorf("Unexpected number of metrics, got %d expected 2", val)
 		return
 	}
+	if val := len(stats); val != 1 {
+		t.Fatalf("Unexpected number of path stats, got %d expected 1", val)
+	}
+	if val := stats[0].cgroups; val != 2 {
+		t.Errorf("Unexpected value for cgroups, got %v", val)
+	}
+	if val := stats[0].processes; val != 8 {
+		t.Errorf("Unexpected value for processes, got %v", val)
+	}
+	if val := stats[0].pidErrors; val != 0 {
+		t.Errorf("Unexpected value for pidErrors, got %v", val)
+	}
 	var m CgroupMetric
 	for _, metric := range metrics {
 		if metric.jobid == "10" {
@@ -116,6 +195,15 @@ func TestCollectSLURM(t *testing.T) {
 	if val := m.cpus; val != 2 {
 		t.Errorf("Unexpected value for cpus, got %v", val)
 	}
+	if val := m.cpuQuota; val != -1 {
+		t.Errorf("Unexpected value for cpuQuota, got %v", val)
+	}
+	if val := m.cpuQuotaCores; val != -1 {
+		t.Errorf("Unexpected value for cpuQuotaCores, got %v", val)
+	}
+	if val := m.cpuPeriod; val != 0.1 {
+		t.Errorf("Unexpected value for cpuPeriod, got %v", val)
+	}
 	if val := m.memoryRSS; val != 311296 {
 		t.Errorf("Unexpected value for memoryRSS, got %v", val)
 	}
@@ -146,6 +234,85 @@ func TestCollectSLURM(t *testing.T) {
 	if val := m.jobid; val != "10" {
 		t.Errorf("Unexpected value for jobid, got %v", val)
 	}
+	if val, ok := m.memoryStat["total_rss"]; !ok || val != 311296 {
+		t.Errorf("Unexpected value for memoryStat total_rss, got %v", val)
+	}
+	if _, ok := m.memoryStat["rss_huge"]; ok {
+		t.Errorf("Unexpected memoryStat key rss_huge")
+	}
+	if val, ok := m.memoryValues["low"]; !ok || val != 2147483648 {
+		t.Errorf("Unexpected value for memoryLow, got %v", val)
+	}
+	if val, ok := m.memoryValues["peak"]; !ok || val != 552960 {
+		t.Errorf("Unexpected value for memoryPeak, got %v", val)
+	}
+	if val := m.pids; val != true {
+		t.Errorf("Unexpected value for pids, got %v", val)
+	}
+	if val := m.pidsCurrent; val != 3 {
+		t.Errorf("Unexpected value for pidsCurrent, got %v", val)
+	}
+	if val := m.pidsMax; val != 512 {
+		t.Errorf("Unexpected value for pidsMax, got %v", val)
+	}
+	if val := m.pidsEventsMax; val != 4 {
+		t.Errorf("Unexpected value for pidsEventsMax, got %v", val)
+	}
+	if val := m.cpusEffective; val != 2 {
+		t.Errorf("Unexpected value for cpusEffective, got %v", val)
+	}
+	if val := m.cpu_effective; val != "0,1" {
+		t.Errorf("Unexpected value for cpu_effective, got %v", val)
+	}
+	if val := m.mems_list; val != "0" {
+		t.Errorf("Unexpected value for mems_list, got %v", val)
+	}
+	if val := len(m.numa); val != 8 {
+		t.Errorf("Unexpected number of numa stats, got %d expected 8", val)
+	}
+	for _, n := range m.numa {
+		if n.kind == "anon" && n.node == "1" && n.bytes != float64(os.Getpagesize()) {
+			t.Errorf("Unexpected value for numa anon node 1, got %v", n.bytes)
+		}
+	}
+	if val := len(m.hugetlb); val != 2 {
+		t.Errorf("Unexpected number of hugetlb stats, got %d expected 2", val)
+	} else {
+		if val := m.hugetlb[0].pagesize; val != "1GB" {
+			t.Errorf("Unexpected value for hugetlb pagesize, got %v", val)
+		}
+		if val := m.hugetlb[0].failcnt; val != 1 {
+			t.Errorf("Unexpected value for hugetlb failcnt, got %v", val)
+		}
+		if val := m.hugetlb[1].pagesize; val != "2MB" {
+			t.Errorf("Unexpected value for hugetlb pagesize, got %v", val)
+		}
+		if val := m.hugetlb[1].usage; val != 2097152 {
+			t.Errorf("Unexpected value for hugetlb usage, got %v", val)
+		}
+	}
+	if val := len(m.io); val != 2 {
+		t.Errorf("Unexpected number of io stats, got %d expected 2", val)
+	} else {
+		if val := m.io[0].device; val != "253:1" {
+			t.Errorf("Unexpected value for io device, got %v", val)
+		}
+		if val := m.io[1].device; val != "sda" {
+			t.Errorf("Unexpected value for io device, got %v", val)
+		}
+		if val := m.io[1].readBytes; val != 2170880 {
+			t.Errorf("Unexpected value for io readBytes, got %v", val)
+		}
+		if val := m.io[1].writeBytes; val != 8192 {
+			t.Errorf("Unexpected value for io writeBytes, got %v", val)
+		}
+		if val := m.io[1].readOps; val != 53 {
+			t.Errorf("Unexpected value for io readOps, got %v", val)
+		}
+		if val := m.io[1].writeOps; val != 2 {
+			t.Errorf("Unexpected value for io writeOps, got %v", val)
+		}
+	}
 	if val, ok := m.processExec["/bin/bash"]; !ok {
 		t.Errorf("processExec does not contain /bin/bash")
 	} else {
@@ -161,8 +328,8 @@ func TestCollectTorque(t *testing.T) {
 	level := promslog.NewLevel()
 	level.Set("debug")
 	logger := promslog.New(&promslog.Config{Level: level})
-	exporter := NewExporter([]string{"/torque"}, logger, false)
-	metrics, err := exporter.collectv1()
+	exporter := NewExporter(ConfigFromPaths([]string{"/torque"}), logger, false)
+	metrics, _, err := exporter.collectv1(context.Background())
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err.Error())
 		return
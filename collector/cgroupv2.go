@@ -15,27 +15,27 @@ package collector
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
+	"math"
 	"os"
 	"os/user"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/containerd/cgroups/v3/cgroup2"
+	"github.com/containerd/cgroups/v3/cgroup2/stats"
 	"github.com/prometheus/procfs"
 )
 
-var (
-	// Use this hack to allow unit tests to override /proc location
-	PidGroupPath = cgroup2.PidGroupPath
-)
-
-func NewCgroupV2Collector(paths []string, logger *slog.Logger) Collector {
-	return NewExporter(paths, logger, true)
+func NewCgroupV2Collector(config *Config, logger *slog.Logger) *Exporter {
+	return NewExporter(config, logger, true)
 }
 
 func getInfov2(name string, pids []int, metric *CgroupMetric, logger *slog.Logger) {
@@ -64,21 +64,29 @@ func getInfov2(name string, pids []int, metric *CgroupMetric, logger *slog.Logge
 			return
 		}
 		var proc procfs.Proc
+		var found bool
+		// Processes may exit while being read so try each PID in the cgroup
 		for _, pid := range pids {
-			proc, err = procFS.Proc(pid)
+			p, err := procFS.Proc(pid)
 			if err != nil {
-				logger.Error("Unable to read PID", "pid", pid, "err", err)
-				return
+				logger.Debug("Unable to read PID", "pid", pid, "err", err)
+				continue
 			}
-			exec, err := proc.Executable()
+			exec, err := p.Executable()
 			if err != nil {
-				logger.Error("Unable to read process executable", "pid", pid, "err", err)
-				return
+				logger.Debug("Unable to read process executable", "pid", pid, "err", err)
+				continue
 			}
+			proc = p
+			found = true
 			if filepath.Base(exec) != "sleep" && filepath.Base(exec) != "slurmstepd" {
 				break
 			}
 		}
+		if !found {
+			logger.Error("Unable to read any process to get uid", "path", name)
+			return
+		}
 		procStat, err := proc.NewStatus()
 		if err != nil {
 			logger.Error("Unable to get proc status for PID", "pid", proc.PID, "err", err)
@@ -97,7 +105,11 @@ func getInfov2(name string, pids []int, metric *CgroupMetric, logger *slog.Logge
 	}
 }
 
-func getNamev2(pidPath string, path string, logger *slog.Logger) string {
+func getNamev2(pidPath string, pc *PathConfig, logger *slog.Logger) string {
+	path := pc.Path
+	if name, ok := pc.aggregate(pidPath, pc.group(true)); ok {
+		return name
+	}
 	dirs := strings.Split(pidPath, "/")
 	var name string
 	endIndex := 3
@@ -113,164 +125,447 @@ func getNamev2(pidPath string, path string, logger *slog.Logger) string {
 	return name
 }
 
-func getStatv2(name string, path string) (float64, error) {
-	if !fileExists(path) {
-		return 0, fmt.Errorf("path %s does not exist", path)
+// getCPUMaxv2 returns the CPU quota and period in seconds and the number of CPUs the quota allows
+func getCPUMaxv2(path string) (float64, float64, float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return -1, 0, -1, err
+	}
+	parts := strings.Fields(string(data))
+	if len(parts) != 2 {
+		return -1, 0, -1, cgroup2.ErrInvalidFormat
+	}
+	period, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return -1, 0, -1, cgroup2.ErrInvalidFormat
+	}
+	if parts[0] == "max" {
+		return -1, float64(period) / 1000000.0, -1, nil
+	}
+	quota, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return -1, 0, -1, cgroup2.ErrInvalidFormat
+	}
+	return float64(quota) / 1000000.0, float64(period) / 1000000.0, getQuotaCores(quota, period), nil
+}
+
+func getHugetlbv2(name string) ([]hugetlbStat, error) {
+	var hugetlb []hugetlbStat
+	hugetlbPath := filepath.Join(*CgroupRoot, name)
+	for _, pagesize := range getHugetlbPageSizes(hugetlbPath, "current") {
+		prefix := filepath.Join(hugetlbPath, fmt.Sprintf("hugetlb.%s", pagesize))
+		usage, err := getValue(prefix + ".current")
+		if err != nil {
+			return nil, err
+		}
+		limit, err := getValue(prefix + ".max")
+		if err != nil {
+			return nil, err
+		}
+		events, err := parseStatFile(prefix + ".events")
+		if err != nil {
+			return nil, err
+		}
+		hugetlb = append(hugetlb, hugetlbStat{pagesize: pagesize, usage: usage, limit: limit, failcnt: events["max"]})
 	}
+	return hugetlb, nil
+}
+
+func getNumaStatv2(path string) ([]numaStat, error) {
+	var numa []numaStat
 	f, err := os.Open(path)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	defer f.Close()
 	s := bufio.NewScanner(f)
 	for s.Scan() {
 		parts := strings.Fields(s.Text())
-		if len(parts) != 2 {
-			return 0, cgroup2.ErrInvalidFormat
+		if len(parts) < 2 {
+			return nil, cgroup2.ErrInvalidFormat
 		}
-		v, err := strconv.ParseUint(parts[1], 10, 64)
-		if err != nil {
-			return 0, cgroup2.ErrInvalidFormat
+		for _, field := range parts[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 || !strings.HasPrefix(kv[0], "N") {
+				return nil, cgroup2.ErrInvalidFormat
+			}
+			v, err := strconv.ParseUint(kv[1], 10, 64)
+			if err != nil {
+				return nil, cgroup2.ErrInvalidFormat
+			}
+			numa = append(numa, numaStat{node: strings.TrimPrefix(kv[0], "N"), kind: parts[0], bytes: float64(v)})
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return numa, nil
+}
+
+func getPressurev2(resource string, path string) ([]pressureStat, error) {
+	var pressure []pressureStat
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		parts := strings.Fields(s.Text())
+		if len(parts) != 5 {
+			return nil, cgroup2.ErrInvalidFormat
 		}
-		if parts[0] == name {
-			return float64(v), nil
+		p := pressureStat{resource: resource, kind: parts[0]}
+		for _, field := range parts[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				return nil, cgroup2.ErrInvalidFormat
+			}
+			v, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil {
+				return nil, cgroup2.ErrInvalidFormat
+			}
+			switch kv[0] {
+			case "avg10":
+				p.avg10 = v
+			case "avg60":
+				p.avg60 = v
+			case "avg300":
+				p.avg300 = v
+			case "total":
+				// total is stall time in microseconds
+				p.total = v / 1000000.0
+			}
 		}
+		pressure = append(pressure, p)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
 	}
-	return 0, fmt.Errorf("unable to find stat key %s in %s", name, path)
+	return pressure, nil
 }
 
-func (e *Exporter) getMetricsv2(name string, pids []int, opts cgroup2.InitOpts) (CgroupMetric, error) {
-	metric := CgroupMetric{name: name}
+func (e *Exporter) getMetricsv2(ctx context.Context, p *PathConfig, name string, pids []int, opts cgroup2.InitOpts) (CgroupMetric, error) {
+	metric := CgroupMetric{name: name, cpuQuota: -1, cpuQuotaCores: -1, memoryValues: make(map[string]float64)}
+	release, err := e.pool.acquire(ctx)
+	if err != nil {
+		e.logger.Error("Timeout waiting for worker", "path", name, "err", err)
+		metric.setFailed(reasonTimeout)
+		return metric, err
+	}
+	defer release()
 	e.logger.Debug("Loading cgroup", "path", name)
 	ctrl, err := cgroup2.Load(name, opts)
 	if err != nil {
 		e.logger.Error("Failed to load cgroups", "path", name, "err", err)
-		metric.err = true
+		metric.setFailed(reasonLoadFailed)
 		return metric, err
 	}
-	stats, err := ctrl.Stat()
+	stats, err := ctrl.StatFiltered(statMaskv2(p))
 	if err != nil {
 		e.logger.Error("Failed to get cgroup stats", "path", name)
-		metric.err = true
+		metric.setFailed(reasonStatFailed)
 		return metric, err
 	}
 	if stats == nil {
 		e.logger.Error("Cgroup stats are nil", "path", name)
-		metric.err = true
+		metric.setFailed(reasonStatFailed)
 		return metric, err
 	}
 	if stats.CPU != nil {
 		metric.cpuUser = float64(stats.CPU.UserUsec) / 1000000.0
 		metric.cpuSystem = float64(stats.CPU.SystemUsec) / 1000000.0
 		metric.cpuTotal = float64(stats.CPU.UsageUsec) / 1000000.0
+		metric.cpuPeriods = float64(stats.CPU.NrPeriods)
+		metric.cpuThrottled = float64(stats.CPU.NrThrottled)
+		metric.cpuThrottledSec = float64(stats.CPU.ThrottledUsec) / 1000000.0
 	}
-	// TODO: Move to https://github.com/containerd/cgroups/blob/d131035c7599c51ff4aed27903c45eb3b2cc29d0/cgroup2/manager.go#L593
-	memoryStatPath := filepath.Join(*CgroupRoot, name, "memory.stat")
-	swapcached, err := getStatv2("swapcached", memoryStatPath)
-	if err != nil {
-		e.logger.Error("Unable to get swapcached", "path", name, "err", err)
-		metric.err = true
-		return metric, err
+	if stats.Io != nil {
+		for _, entry := range stats.Io.Usage {
+			device := getBlockDevice(fmt.Sprintf("%d:%d", entry.Major, entry.Minor))
+			metric.io = append(metric.io, ioStat{
+				device:     device,
+				readBytes:  float64(entry.Rbytes),
+				writeBytes: float64(entry.Wbytes),
+				readOps:    float64(entry.Rios),
+				writeOps:   float64(entry.Wios),
+			})
+		}
+	}
+	if p.collects(groupCPU) {
+		e.getCPUv2(name, &metric)
+	}
+	if p.collects(groupMemory) {
+		if err := e.getMemoryv2(name, stats, &metric); err != nil {
+			return metric, err
+		}
+	}
+	// Library returns zero values when pids controller is not enabled
+	if stats.Pids != nil && fileExists(filepath.Join(*CgroupRoot, name, "pids.current")) {
+		metric.pids = true
+		metric.pidsCurrent = float64(stats.Pids.Current)
+		if stats.Pids.Limit == math.MaxUint64 {
+			metric.pidsMax = -1
+		} else {
+			metric.pidsMax = float64(stats.Pids.Limit)
+		}
+		pidsEventsPath := filepath.Join(*CgroupRoot, name, "pids.events")
+		if pidsEvents, err := parseStatFile(pidsEventsPath); err == nil {
+			metric.pidsEventsMax = pidsEvents["max"]
+		} else {
+			e.logger.Debug("Unable to get pids.events", "path", name, "err", err)
+		}
+	}
+	if p.collects(groupHugetlb) {
+		if hugetlb, err := getHugetlbv2(name); err == nil {
+			metric.hugetlb = hugetlb
+		} else {
+			e.logger.Error("Unable to get hugetlb stats", "path", name, "err", err)
+		}
+	}
+	if p.collects(groupPressure) {
+		for _, resource := range []string{"cpu", "memory", "io"} {
+			pressurePath := filepath.Join(*CgroupRoot, name, fmt.Sprintf("%s.pressure", resource))
+			if !fileExists(pressurePath) {
+				e.logger.Debug("Pressure stall information not present", "path", name, "resource", resource)
+				continue
+			}
+			pressure, err := getPressurev2(resource, pressurePath)
+			if err != nil {
+				e.logger.Error("Unable to get pressure stall information", "path", name, "resource", resource, "err", err)
+				continue
+			}
+			metric.pressure = append(metric.pressure, pressure...)
+		}
 	}
-	if stats.Memory != nil {
-		metric.memoryRSS = float64(stats.Memory.Anon) + swapcached + float64(stats.Memory.File)
-		metric.memoryUsed = float64(stats.Memory.Usage)
-		metric.memoryTotal = float64(stats.Memory.UsageLimit)
-		metric.memoryCache = float64(stats.Memory.File)
-		metric.memswUsed = float64(stats.Memory.SwapUsage)
-		metric.memswTotal = float64(stats.Memory.SwapLimit)
-		if stats.MemoryEvents != nil {
-			metric.memoryFailCount = float64(stats.MemoryEvents.Oom)
+	if p.collects(groupNuma) {
+		numaStatPath := filepath.Join(*CgroupRoot, name, "memory.numa_stat")
+		if numa, err := getNumaStatv2(numaStatPath); err == nil {
+			metric.numa = e.filterNumaStat(numa)
+		} else {
+			e.logger.Debug("Unable to get memory.numa_stat", "path", name, "err", err)
 		}
 	}
-	// TODO: cpuset.cpus.effective?
+	getInfov2(name, pids, &metric, e.logger)
+	// Process info acquires a worker per PID
+	release()
+	if p.proc() {
+		e.logger.Debug("Get process info", "pids", fmt.Sprintf("%v", pids))
+		getProcInfo(ctx, e.pool, pids, &metric, e.logger)
+	}
+	return metric, nil
+}
+
+// statMaskv2 returns the controllers read by Stat for the metric groups of a path
+func statMaskv2(p *PathConfig) cgroup2.StatMask {
+	var mask cgroup2.StatMask
+	if p.collects(groupCPU) {
+		mask |= cgroup2.StatCPU
+	}
+	if p.collects(groupMemory) {
+		mask |= cgroup2.StatMemory | cgroup2.StatMemoryEvents
+	}
+	if p.collects(groupIO) {
+		mask |= cgroup2.StatIO
+	}
+	if p.collects(groupPids) {
+		mask |= cgroup2.StatPids
+	}
+	return mask
+}
+
+// getCPUv2 reads the CPU quota and cpuset of a cgroup
+func (e *Exporter) getCPUv2(name string, metric *CgroupMetric) {
+	cpuMaxPath := filepath.Join(*CgroupRoot, name, "cpu.max")
+	if quota, period, cores, err := getCPUMaxv2(cpuMaxPath); err == nil {
+		metric.cpuQuota = quota
+		metric.cpuPeriod = period
+		metric.cpuQuotaCores = cores
+	} else {
+		e.logger.Debug("Unable to get cpu.max", "path", name, "err", err)
+	}
 	cpusPath := filepath.Join(*CgroupRoot, name, "cpuset.cpus")
 	if cpus, err := getCPUs(cpusPath, e.logger); err == nil {
 		metric.cpus = len(cpus)
 		metric.cpu_list = strings.Join(cpus, ",")
 	}
-	getInfov2(name, pids, &metric, e.logger)
-	if *collectProc {
-		e.logger.Debug("Get process info", "pids", fmt.Sprintf("%v", pids))
-		getProcInfo(pids, &metric, e.logger)
+	effectiveCpusPath := filepath.Join(*CgroupRoot, name, "cpuset.cpus.effective")
+	if cpus, err := getCPUs(effectiveCpusPath, e.logger); err == nil {
+		metric.cpusEffective = len(cpus)
+		metric.cpu_effective = strings.Join(cpus, ",")
+	}
+	memsPath := filepath.Join(*CgroupRoot, name, "cpuset.mems")
+	if mems, err := getCPUs(memsPath, e.logger); err == nil {
+		metric.mems_list = strings.Join(mems, ",")
 	}
-	return metric, nil
 }
 
-func (e *Exporter) collectv2() ([]CgroupMetric, error) {
-	var names []string
-	var metrics []CgroupMetric
-	for _, path := range e.paths {
-		var group string
-		// Allows previous cgroupv1 path to work as default for cgroupv2 path
-		if path == "/slurm" {
-			group = "/system.slice/slurmstepd.scope"
-		} else {
-			group = path
+// getMemoryv2 reads the memory usage, limits, events and memory.stat of a cgroup
+func (e *Exporter) getMemoryv2(name string, stat *stats.Metrics, metric *CgroupMetric) error {
+	// TODO: Move to https://github.com/containerd/cgroups/blob/d131035c7599c51ff4aed27903c45eb3b2cc29d0/cgroup2/manager.go#L593
+	memoryStatPath := filepath.Join(*CgroupRoot, name, "memory.stat")
+	memoryStat, err := parseStatFile(memoryStatPath)
+	if err != nil {
+		e.logger.Error("Unable to get memory.stat", "path", name, "err", err)
+		metric.setFailed(reasonMemoryStatMissing)
+		return err
+	}
+	swapcached, ok := memoryStat["swapcached"]
+	if !ok {
+		err = fmt.Errorf("unable to find stat key swapcached in %s", memoryStatPath)
+		e.logger.Error("Unable to get swapcached", "path", name, "err", err)
+		metric.setFailed(reasonMemoryStatMissing)
+		return err
+	}
+	metric.memoryStat = e.filterMemoryStat(memoryStat)
+	if stat.Memory != nil {
+		metric.memoryRSS = float64(stat.Memory.Anon) + swapcached + float64(stat.Memory.File)
+		metric.memoryUsed = float64(stat.Memory.Usage)
+		metric.memoryTotal = float64(stat.Memory.UsageLimit)
+		metric.memoryCache = float64(stat.Memory.File)
+		metric.memswUsed = float64(stat.Memory.SwapUsage)
+		metric.memswTotal = float64(stat.Memory.SwapLimit)
+		if stat.MemoryEvents != nil {
+			metric.memoryFailCount = float64(stat.MemoryEvents.Oom)
 		}
-		e.logger.Debug("Loading cgroup", "path", path, "group", group, "root", *CgroupRoot)
-		//TODO
-		//control, err := cgroup2.LoadSystemd(path, group)
-		opts := cgroup2.WithMountpoint(*CgroupRoot)
-		control, err := cgroup2.Load(group, opts)
+	}
+	for _, key := range []string{"high", "low", "min", "peak"} {
+		file := "memory." + key
+		v, err := getValue(filepath.Join(*CgroupRoot, name, file))
 		if err != nil {
-			e.logger.Error("Error loading cgroup", "path", path, "group", group, "err", err)
-			metric := CgroupMetric{name: path, err: true}
-			metrics = append(metrics, metric)
+			e.logger.Debug("Unable to get memory value", "path", name, "file", file, "err", err)
 			continue
 		}
-		processes, err := control.Procs(true)
+		metric.memoryValues[key] = v
+	}
+	memoryEventsPath := filepath.Join(*CgroupRoot, name, "memory.events")
+	if memoryEvents, err := parseStatFile(memoryEventsPath); err == nil {
+		metric.memoryEvents = memoryEvents
+	} else {
+		e.logger.Debug("Unable to get memory.events", "path", name, "err", err)
+	}
+	swapEventsPath := filepath.Join(*CgroupRoot, name, "memory.swap.events")
+	if swapEvents, err := parseStatFile(swapEventsPath); err == nil {
+		metric.memswEvents = swapEvents
+		metric.memswFailCount = swapEvents["fail"]
+	} else {
+		e.logger.Debug("Unable to get memory.swap.events", "path", name, "err", err)
+	}
+	return nil
+}
+
+func (e *Exporter) collectv2(ctx context.Context) ([]CgroupMetric, []pathStat, error) {
+	var metrics []CgroupMetric
+	var stats []pathStat
+	paths := e.expandPaths(e.getPaths())
+	for i := range paths {
+		start := time.Now()
+		pathMetrics, stat := e.collectPathv2(ctx, &paths[i])
+		stat.duration = time.Since(start).Seconds()
+		metrics = append(metrics, pathMetrics...)
+		stats = append(stats, stat)
+	}
+	return metrics, stats, nil
+}
+
+// getPidsv2 walks the cgroup tree under group and indexes the PIDs in each cgroup.procs by cgroup name
+func (e *Exporter) getPidsv2(pc *PathConfig, group string, stat *pathStat) (*pidIndex, error) {
+	path := pc.Path
+	index := newPidIndex()
+	root := filepath.Join(*CgroupRoot, group)
+	err := filepath.WalkDir(root, func(dir string, d fs.DirEntry, err error) error {
 		if err != nil {
-			e.logger.Error("Error loading cgroup processes", "path", path, "group", group, "err", err)
-			metric := CgroupMetric{name: path, err: true}
-			metrics = append(metrics, metric)
-			continue
-		}
-		e.logger.Debug("Found processes", "path", path, "group", group, "processes", len(processes))
-		pids := make(map[string][]int)
-		for _, p := range processes {
-			pid := int(p)
-			pidPath, err := PidGroupPath(pid)
-			if err != nil {
-				e.logger.Error("Error getting PID group path", "path", path, "group", group, "pid", pid, "err", err)
-				continue
-			}
-			e.logger.Debug("Get Name", "pid", pid, "path", path)
-			name := getNamev2(pidPath, path, e.logger)
-			if strings.Contains(path, "slurm") && filepath.Base(name) == "system" {
-				e.logger.Debug("Skip system cgroup", "name", name)
-				continue
-			}
-			if !sliceContains(names, name) {
-				names = append(names, name)
+			// Cgroups removed during the walk are skipped
+			if dir != root && errors.Is(err, fs.ErrNotExist) {
+				return nil
 			}
-			if val, ok := pids[name]; ok {
-				if !sliceContains(val, pid) {
-					val = append(val, pid)
-				}
-				pids[name] = val
-			} else {
-				pids[name] = []int{pid}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		pids, err := readProcs(filepath.Join(dir, "cgroup.procs"))
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				e.logger.Error("Error reading cgroup processes", "path", path, "dir", dir, "err", err)
+				stat.procsErrs++
 			}
+			return nil
+		}
+		if len(pids) == 0 {
+			return nil
 		}
-		wg := &sync.WaitGroup{}
-		wg.Add(len(names))
-		for _, name := range names {
-			go func(n string, p map[string][]int) {
-				defer wg.Done()
-				var pids []int
-				if val, ok := p[n]; ok {
-					pids = val
-				} else {
-					e.logger.Error("Unable to get PIDs for name", "name", n)
-					return
-				}
-				metric, _ := e.getMetricsv2(n, pids, opts)
-				metricLock.Lock()
-				metrics = append(metrics, metric)
-				metricLock.Unlock()
-			}(name, pids)
+		stat.processes += len(pids)
+		rel, err := filepath.Rel(*CgroupRoot, dir)
+		if err != nil {
+			return err
+		}
+		name := getNamev2("/"+rel, pc, e.logger)
+		if strings.Contains(path, "slurm") && filepath.Base(name) == "system" {
+			e.logger.Debug("Skip system cgroup", "name", name)
+			return nil
 		}
-		wg.Wait()
+		for _, pid := range pids {
+			index.add(name, pid)
+		}
+		return nil
+	})
+	return index, err
+}
+
+// readProcs returns the PIDs listed in a cgroup.procs file
+func readProcs(path string) ([]int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
 	}
-	return metrics, nil
+	defer file.Close()
+	var pids []int
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		pid, err := strconv.Atoi(strings.TrimSpace(scanner.Text()))
+		if err != nil {
+			return nil, err
+		}
+		pids = append(pids, pid)
+	}
+	return pids, scanner.Err()
+}
+
+func (e *Exporter) collectPathv2(ctx context.Context, pc *PathConfig) ([]CgroupMetric, pathStat) {
+	path := pc.Path
+	group := pc.group(true)
+	stat := pathStat{path: path}
+	if ctx.Err() != nil {
+		e.logger.Error("Timeout before loading cgroup", "path", path, "err", ctx.Err())
+		return []CgroupMetric{pathError(path, reasonTimeout)}, stat
+	}
+	e.logger.Debug("Loading cgroup", "path", path, "group", group, "root", *CgroupRoot)
+	//TODO
+	//control, err := cgroup2.LoadSystemd(path, group)
+	opts := cgroup2.WithMountpoint(*CgroupRoot)
+	index, err := e.getPidsv2(pc, group, &stat)
+	if err != nil {
+		e.logger.Error("Error loading cgroup processes", "path", path, "group", group, "err", err)
+		return []CgroupMetric{pathError(path, reasonLoadFailed)}, stat
+	}
+	e.logger.Debug("Found processes", "path", path, "group", group, "processes", stat.processes)
+	names := pc.filter(index.names)
+	if len(names) != len(index.names) {
+		e.logger.Debug("Filtered cgroups", "path", path, "cgroups", len(index.names), "collected", len(names))
+	}
+	stat.cgroups = len(index.names)
+	metrics := e.getMetrics(ctx, names, func(n string) (CgroupMetric, bool) {
+		val, ok := index.pids[n]
+		if !ok {
+			e.logger.Error("Unable to get PIDs for name", "name", n)
+			metric := CgroupMetric{name: n}
+			metric.setFailed(reasonPidsUnavailable)
+			return metric, true
+		}
+		metric, _ := e.getMetricsv2(ctx, pc, n, val, opts)
+		return metric, true
+	})
+	pc.apply(metrics)
+	return metrics, stat
 }
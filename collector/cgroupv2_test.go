@@ -14,44 +14,109 @@
 package collector
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/promslog"
 )
 
-func TestGetStatv2(t *testing.T) {
-	_, err := getStatv2("swapcached", "/dne")
+func TestParseStatFile(t *testing.T) {
+	_, err := parseStatFile("/dne")
 	if err == nil {
 		t.Errorf("Expected error with /dne but none given")
 	}
 	path := filepath.Join(*CgroupRoot, "system.slice")
-	_, err = getStatv2("swapcached", path)
+	_, err = parseStatFile(path)
 	if err == nil {
-		t.Errorf("Expected error with /dne but none given")
+		t.Errorf("Expected error with directory but none given")
 	}
 	path = filepath.Join(*CgroupRoot, "user.slice/user-20821.slice/memory.max")
-	_, err = getStatv2("swapcached", path)
+	_, err = parseStatFile(path)
 	if err == nil {
 		t.Errorf("Expected error with single value file but none given")
 	}
 	path = filepath.Join(*CgroupRoot, "stat.invalid")
-	_, err = getStatv2("nan", path)
+	_, err = parseStatFile(path)
 	if err == nil {
 		t.Errorf("Expected error with stat.invalid but none given")
 	}
 	path = filepath.Join(*CgroupRoot, "user.slice/user-20821.slice/memory.stat")
-	_, err = getStatv2("dne", path)
+	stats, err := parseStatFile(path)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if stat, ok := stats["swapcached"]; !ok || stat != 0 {
+		t.Errorf("Unexpectd value for swapcached: %v", stat)
+	}
+}
+
+func TestGetCPUMaxv2(t *testing.T) {
+	_, _, _, err := getCPUMaxv2("/dne")
+	if err == nil {
+		t.Errorf("Expected error with /dne but none given")
+	}
+	path := filepath.Join(*CgroupRoot, "user.slice/user-20821.slice/memory.max")
+	_, _, _, err = getCPUMaxv2(path)
+	if err == nil {
+		t.Errorf("Expected error with single value file but none given")
+	}
+	path = filepath.Join(*CgroupRoot, "stat.invalid")
+	_, _, _, err = getCPUMaxv2(path)
+	if err == nil {
+		t.Errorf("Expected error with stat.invalid but none given")
+	}
+	path = filepath.Join(*CgroupRoot, "system.slice/slurmstepd.scope/job_4/cpu.max")
+	quota, period, cores, err := getCPUMaxv2(path)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if quota != -1 {
+		t.Errorf("Unexpected value for quota: %v", quota)
+	}
+	if period != 0.1 {
+		t.Errorf("Unexpected value for period: %v", period)
+	}
+	if cores != -1 {
+		t.Errorf("Unexpected value for cores: %v", cores)
+	}
+}
+
+func TestGetPressurev2(t *testing.T) {
+	_, err := getPressurev2("cpu", "/dne")
+	if err == nil {
+		t.Errorf("Expected error with /dne but none given")
+	}
+	path := filepath.Join(*CgroupRoot, "stat.invalid")
+	_, err = getPressurev2("cpu", path)
 	if err == nil {
-		t.Errorf("Expected error when stat key missing but none given")
+		t.Errorf("Expected error with stat.invalid but none given")
 	}
-	stat, err := getStatv2("swapcached", path)
+	path = filepath.Join(*CgroupRoot, "system.slice/slurmstepd.scope/job_4/memory.pressure")
+	pressure, err := getPressurev2("memory", path)
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err)
+		return
+	}
+	if val := len(pressure); val != 2 {
+		t.Errorf("Unexpected number of pressure stats, got %d expected 2", val)
+		return
 	}
-	if stat != 0 {
-		t.Errorf("Unexpectd value: %v", stat)
+	if val := pressure[1].kind; val != "full" {
+		t.Errorf("Unexpected value for kind, got %v", val)
+	}
+	if val := pressure[1].avg10; val != 10.01 {
+		t.Errorf("Unexpected value for avg10, got %v", val)
+	}
+	if val := pressure[1].avg300; val != 2.55 {
+		t.Errorf("Unexpected value for avg300, got %v", val)
+	}
+	if val := pressure[1].total; val != 8.012233 {
+		t.Errorf("Unexpected value for total, got %v", val)
 	}
 }
 
@@ -59,8 +124,8 @@ func TestCollectv2Error(t *testing.T) {
 	level := promslog.NewLevel()
 	level.Set("debug")
 	logger := promslog.New(&promslog.Config{Level: level})
-	exporter := NewExporter([]string{"/dne"}, logger, true)
-	metrics, err := exporter.collectv2()
+	exporter := NewExporter(ConfigFromPaths([]string{"/dne"}), logger, true)
+	metrics, _, err := exporter.collectv2(context.Background())
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err.Error())
 		return
@@ -72,22 +137,54 @@ func TestCollectv2Error(t *testing.T) {
 	if val := metrics[0].err; val != true {
 		t.Errorf("Unexpected value for err, got %v", val)
 	}
+	if val := metrics[0].errReason; val != "load_failed" {
+		t.Errorf("Unexpected value for errReason, got %v", val)
+	}
 }
 
-func TestCollectv2UserSlice(t *testing.T) {
+func TestCollectv2WithoutMemoryPeak(t *testing.T) {
 	varFalse := false
 	collectProc = &varFalse
-	PidGroupPath = func(pid int) (string, error) {
-		if pid == 67998 {
-			return "/user.slice/user-20821.slice/session-157.scope", nil
-		}
-		return "", fmt.Errorf("Could not find cgroup path for %d", pid)
+	exporter := NewExporter(ConfigFromPaths([]string{"/legacy.slice"}), promslog.NewNopLogger(), true)
+	metrics, _, err := exporter.collectv2(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if val := len(metrics); val != 1 {
+		t.Fatalf("Unexpected number of metrics, got %d expected 1", val)
+	}
+	if val, ok := metrics[0].memoryValues["peak"]; ok {
+		t.Errorf("Unexpected value for memoryPeak, got %v", val)
+	}
+	if val, ok := metrics[0].memoryValues["high"]; !ok || val != 1.8446744073709552e+19 {
+		t.Errorf("Unexpected value for memoryHigh, got %v", val)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(exporter)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Unexpected error gathering metrics: %s", err)
+	}
+	names := make(map[string]bool)
+	for _, f := range families {
+		names[f.GetName()] = true
+	}
+	if names["cgroup_memory_peak_bytes"] {
+		t.Errorf("Unexpected cgroup_memory_peak_bytes without memory.peak")
+	}
+	if !names["cgroup_memory_high_bytes"] {
+		t.Errorf("Expected cgroup_memory_high_bytes but none given")
 	}
+}
+
+func TestCollectv2UserSlice(t *testing.T) {
+	varFalse := false
+	collectProc = &varFalse
 	level := promslog.NewLevel()
 	level.Set("debug")
 	logger := promslog.New(&promslog.Config{Level: level})
-	exporter := NewExporter([]string{"/user.slice"}, logger, true)
-	metrics, err := exporter.collectv2()
+	exporter := NewExporter(ConfigFromPaths([]string{"/user.slice"}), logger, true)
+	metrics, stats, err := exporter.collectv2(context.Background())
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err.Error())
 		return
@@ -96,6 +193,21 @@ func TestCollectv2UserSlice(t *testing.T) {
 		t.Errorf("Unexpected number of metrics, got %d expected 1", val)
 		return
 	}
+	if val := len(stats); val != 1 {
+		t.Fatalf("Unexpected number of path stats, got %d expected 1", val)
+	}
+	if val := stats[0].path; val != "/user.slice" {
+		t.Errorf("Unexpected value for path, got %v", val)
+	}
+	if val := stats[0].cgroups; val != 1 {
+		t.Errorf("Unexpected value for cgroups, got %v", val)
+	}
+	if val := stats[0].processes; val != 12 {
+		t.Errorf("Unexpected value for processes, got %v", val)
+	}
+	if val := stats[0].procsErrs; val != 0 {
+		t.Errorf("Unexpected value for procsErrors, got %v", val)
+	}
 	if val := metrics[0].name; val != "/user.slice/user-20821.slice" {
 		t.Errorf("Unexpected value for name, got %v", val)
 	}
@@ -111,6 +223,21 @@ func TestCollectv2UserSlice(t *testing.T) {
 	if val := metrics[0].cpus; val != 0 {
 		t.Errorf("Unexpected value for cpus, got %v", val)
 	}
+	if val := metrics[0].cpusEffective; val != 0 {
+		t.Errorf("Unexpected value for cpusEffective, got %v", val)
+	}
+	if val := metrics[0].cpuPeriods; val != 96 {
+		t.Errorf("Unexpected value for cpuPeriods, got %v", val)
+	}
+	if val := metrics[0].cpuQuota; val != 0.1 {
+		t.Errorf("Unexpected value for cpuQuota, got %v", val)
+	}
+	if val := metrics[0].cpuPeriod; val != 0.1 {
+		t.Errorf("Unexpected value for cpuPeriod, got %v", val)
+	}
+	if val := metrics[0].cpuQuotaCores; val != 1 {
+		t.Errorf("Unexpected value for cpuQuotaCores, got %v", val)
+	}
 	if val := metrics[0].memoryRSS; val != 22626304 {
 		t.Errorf("Unexpected value for memoryRSS, got %v", val)
 	}
@@ -129,6 +256,24 @@ func TestCollectv2UserSlice(t *testing.T) {
 	if val := metrics[0].memswTotal; val != 1.8446744073709552e+19 {
 		t.Errorf("Unexpected value for swapTotal, got %v", val)
 	}
+	if val, ok := metrics[0].memoryValues["high"]; !ok || val != 1.8446744073709552e+19 {
+		t.Errorf("Unexpected value for memoryHigh, got %v", val)
+	}
+	if val, ok := metrics[0].memoryValues["peak"]; !ok || val != 315523072 {
+		t.Errorf("Unexpected value for memoryPeak, got %v", val)
+	}
+	if val := metrics[0].pids; val != true {
+		t.Errorf("Unexpected value for pids, got %v", val)
+	}
+	if val := metrics[0].pidsCurrent; val != 12 {
+		t.Errorf("Unexpected value for pidsCurrent, got %v", val)
+	}
+	if val := metrics[0].pidsMax; val != 20065 {
+		t.Errorf("Unexpected value for pidsMax, got %v", val)
+	}
+	if val := metrics[0].pidsEventsMax; val != 0 {
+		t.Errorf("Unexpected value for pidsEventsMax, got %v", val)
+	}
 	if val := metrics[0].uid; val != "20821" {
 		t.Errorf("Unexpected value for uid, got %v", val)
 	}
@@ -139,20 +284,11 @@ func TestCollectv2SLURM(t *testing.T) {
 	collectProc = &varTrue
 	varLen := 100
 	collectProcMaxExec = &varLen
-	PidGroupPath = func(pid int) (string, error) {
-		if pid == 49276 {
-			return "/system.slice/slurmstepd.scope/job_4/step_0/user/task_0", nil
-		}
-		if pid == 43310 {
-			return "/system.slice/slurmstepd.scope/system", nil
-		}
-		return "", fmt.Errorf("Could not find cgroup path for %d", pid)
-	}
 	level := promslog.NewLevel()
 	level.Set("debug")
 	logger := promslog.New(&promslog.Config{Level: level})
-	exporter := NewExporter([]string{"/slurm"}, logger, true)
-	metrics, err := exporter.collectv2()
+	exporter := NewExporter(ConfigFromPaths([]string{"/slurm"}), logger, true)
+	metrics, _, err := exporter.collectv2(context.Background())
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err.Error())
 		return
@@ -186,6 +322,18 @@ func TestCollectv2SLURM(t *testing.T) {
 	if val := m.cpus; val != 1 {
 		t.Errorf("Unexpected value for cpus, got %v", val)
 	}
+	if val := m.cpuPeriods; val != 52 {
+		t.Errorf("Unexpected value for cpuPeriods, got %v", val)
+	}
+	if val := m.cpuThrottled; val != 3 {
+		t.Errorf("Unexpected value for cpuThrottled, got %v", val)
+	}
+	if val := m.cpuThrottledSec; val != 0.028541 {
+		t.Errorf("Unexpected value for cpuThrottledSec, got %v", val)
+	}
+	if val := m.cpuQuota; val != -1 {
+		t.Errorf("Unexpected value for cpuQuota, got %v", val)
+	}
 	if val := m.memoryRSS; val != 2777088 {
 		t.Errorf("Unexpected value for memoryRSS, got %v", val)
 	}
@@ -204,12 +352,107 @@ func TestCollectv2SLURM(t *testing.T) {
 	if val := m.memswTotal; val != 1835008000 {
 		t.Errorf("Unexpected value for swapTotal, got %v", val)
 	}
+	if val, ok := m.memoryValues["high"]; !ok || val != 1835008000 {
+		t.Errorf("Unexpected value for memoryHigh, got %v", val)
+	}
+	if val, ok := m.memoryValues["min"]; !ok || val != 0 {
+		t.Errorf("Unexpected value for memoryMin, got %v", val)
+	}
+	if val, ok := m.memoryValues["peak"]; !ok || val != 7229440 {
+		t.Errorf("Unexpected value for memoryPeak, got %v", val)
+	}
+	if val := m.memswFailCount; val != 1 {
+		t.Errorf("Unexpected value for swapFailCount, got %v", val)
+	}
+	if val, ok := m.memoryEvents["max"]; !ok || val != 12 {
+		t.Errorf("Unexpected value for memoryEvents max, got %v", val)
+	}
+	if val, ok := m.memoryEvents["oom_kill"]; !ok || val != 0 {
+		t.Errorf("Unexpected value for memoryEvents oom_kill, got %v", val)
+	}
+	if val, ok := m.memswEvents["max"]; !ok || val != 2 {
+		t.Errorf("Unexpected value for memswEvents max, got %v", val)
+	}
 	if val := m.uid; val != "20821" {
 		t.Errorf("Unexpected value for uid, got %v", val)
 	}
 	if val := m.jobid; val != "4" {
 		t.Errorf("Unexpected value for jobid, got %v", val)
 	}
+	if val, ok := m.memoryStat["kernel_stack"]; !ok || val != 98304 {
+		t.Errorf("Unexpected value for memoryStat kernel_stack, got %v", val)
+	}
+	if val, ok := m.memoryStat["pgfault"]; !ok || val != 11082 {
+		t.Errorf("Unexpected value for memoryStat pgfault, got %v", val)
+	}
+	if val := m.pids; val != false {
+		t.Errorf("Unexpected value for pids, got %v", val)
+	}
+	if val := m.cpusEffective; val != 1 {
+		t.Errorf("Unexpected value for cpusEffective, got %v", val)
+	}
+	if val := m.cpu_effective; val != "0" {
+		t.Errorf("Unexpected value for cpu_effective, got %v", val)
+	}
+	if val := m.mems_list; val != "0" {
+		t.Errorf("Unexpected value for mems_list, got %v", val)
+	}
+	if val := len(m.numa); val != 10 {
+		t.Errorf("Unexpected number of numa stats, got %d expected 10", val)
+	}
+	for _, n := range m.numa {
+		if n.kind == "anon" && n.bytes != 2260992 {
+			t.Errorf("Unexpected value for numa anon, got %v", n.bytes)
+		}
+		if n.kind == "pagetables" {
+			t.Errorf("Unexpected numa type pagetables")
+		}
+	}
+	if val := len(m.hugetlb); val != 2 {
+		t.Errorf("Unexpected number of hugetlb stats, got %d expected 2", val)
+	} else {
+		if val := m.hugetlb[0].pagesize; val != "1GB" {
+			t.Errorf("Unexpected value for hugetlb pagesize, got %v", val)
+		}
+		if val := m.hugetlb[0].limit; val != 2147483648 {
+			t.Errorf("Unexpected value for hugetlb limit, got %v", val)
+		}
+		if val := m.hugetlb[0].failcnt; val != 3 {
+			t.Errorf("Unexpected value for hugetlb failcnt, got %v", val)
+		}
+		if val := m.hugetlb[1].usage; val != 4194304 {
+			t.Errorf("Unexpected value for hugetlb usage, got %v", val)
+		}
+	}
+	if val := len(m.io); val != 2 {
+		t.Errorf("Unexpected number of io stats, got %d expected 2", val)
+	} else {
+		if val := m.io[0].device; val != "sda" {
+			t.Errorf("Unexpected value for io device, got %v", val)
+		}
+		if val := m.io[0].readBytes; val != 1056768 {
+			t.Errorf("Unexpected value for io readBytes, got %v", val)
+		}
+		if val := m.io[0].writeOps; val != 12 {
+			t.Errorf("Unexpected value for io writeOps, got %v", val)
+		}
+		if val := m.io[1].device; val != "dm-0" {
+			t.Errorf("Unexpected value for io device, got %v", val)
+		}
+	}
+	if val := len(m.pressure); val != 6 {
+		t.Errorf("Unexpected number of pressure stats, got %d expected 6", val)
+	}
+	for _, p := range m.pressure {
+		if p.resource == "cpu" && p.kind == "some" {
+			if p.avg60 != 0.87 {
+				t.Errorf("Unexpected value for cpu some avg60, got %v", p.avg60)
+			}
+			if p.total != 1.28573 {
+				t.Errorf("Unexpected value for cpu some total, got %v", p.total)
+			}
+		}
+	}
 	if val, ok := m.processExec["/usr/bin/bash"]; !ok {
 		t.Errorf("processExec does not contain /bin/bash")
 	} else {
@@ -218,3 +461,74 @@ func TestCollectv2SLURM(t *testing.T) {
 		}
 	}
 }
+
+// writeProcsTree creates a cgroup v2 tree of slurm jobs with procs processes spread evenly across jobs
+func writeProcsTree(tb testing.TB, root string, jobs int, procs int) {
+	pid := 1
+	for j := 0; j < jobs; j++ {
+		dir := filepath.Join(root, "system.slice", "slurmstepd.scope", fmt.Sprintf("job_%d", j), "step_0", "user", "task_0")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			tb.Fatal(err)
+		}
+		var lines []string
+		for i := 0; i < procs/jobs; i++ {
+			lines = append(lines, fmt.Sprintf("%d", pid))
+			pid++
+		}
+		if err := os.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+func TestGetPidsv2(t *testing.T) {
+	root := t.TempDir()
+	writeProcsTree(t, root, 3, 30)
+	invalid := filepath.Join(root, "system.slice", "slurmstepd.scope", "job_2", "cgroup.procs")
+	if err := os.WriteFile(invalid, []byte("foo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cgroupRoot := *CgroupRoot
+	CgroupRoot = &root
+	defer func() { CgroupRoot = &cgroupRoot }()
+	exporter := NewExporter(ConfigFromPaths([]string{"/slurm"}), promslog.NewNopLogger(), true)
+	stat := pathStat{path: "/slurm"}
+	index, err := exporter.getPidsv2(&PathConfig{Path: "/slurm"}, "/system.slice/slurmstepd.scope", &stat)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if val := len(index.names); val != 3 {
+		t.Errorf("Unexpected number of cgroups, got %d expected 3", val)
+	}
+	if val := index.names[0]; val != "/system.slice/slurmstepd.scope/job_0" {
+		t.Errorf("Unexpected name, got %s", val)
+	}
+	if val := len(index.pids["/system.slice/slurmstepd.scope/job_1"]); val != 10 {
+		t.Errorf("Unexpected number of PIDs, got %d expected 10", val)
+	}
+	if val := stat.processes; val != 30 {
+		t.Errorf("Unexpected value for processes, got %d expected 30", val)
+	}
+	if val := stat.procsErrs; val != 1 {
+		t.Errorf("Unexpected value for procsErrors, got %d expected 1", val)
+	}
+	if _, err := exporter.getPidsv2(&PathConfig{Path: "/dne"}, "/dne", &stat); err == nil {
+		t.Errorf("Expected error for path that does not exist")
+	}
+}
+
+func BenchmarkGetPidsv2(b *testing.B) {
+	root := b.TempDir()
+	writeProcsTree(b, root, 1000, 100000)
+	cgroupRoot := *CgroupRoot
+	CgroupRoot = &root
+	defer func() { CgroupRoot = &cgroupRoot }()
+	exporter := NewExporter(ConfigFromPaths([]string{"/slurm"}), promslog.NewNopLogger(), true)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stat := pathStat{path: "/slurm"}
+		if _, err := exporter.getPidsv2(&PathConfig{Path: "/slurm"}, "/system.slice/slurmstepd.scope", &stat); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -14,13 +14,21 @@
 package collector
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
+	"maps"
+	"math"
 	"os"
-	"reflect"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/prometheus/client_golang/prometheus"
@@ -32,6 +40,13 @@ var (
 	CgroupRoot         = kingpin.Flag("path.cgroup.root", "Root path to cgroup fs").Default(defCgroupRoot).String()
 	collectProcMaxExec = kingpin.Flag("collect.proc.max-exec", "Max length of process executable to record").Default("100").Int()
 	ProcRoot           = kingpin.Flag("path.proc.root", "Root path to proc fs").Default(defProcRoot).String()
+	collectMemoryStat  = kingpin.Flag("collect.memory.stat", "Comma separated list of memory.stat keys to collect, 'all' collects every key").Default(defMemoryStat).String()
+	collectNumaStat    = kingpin.Flag("collect.memory.numa", "Comma separated list of memory.numa_stat types to collect, 'all' collects every type").Default(defNumaStat).String()
+	collectInterval    = kingpin.Flag("collect.interval", "Interval to collect metrics in the background and serve the latest snapshot on scrape, 0 collects on each scrape").Default("0s").Duration()
+	collectConcurrency = kingpin.Flag("collect.concurrency", "Max number of cgroups and processes read at the same time, 0 is unlimited").Default("32").Int()
+	collectInclude     = kingpin.Flag("collect.include", "Regex of cgroup names to collect, matched against the whole name before it is renamed").Default("").String()
+	collectExclude     = kingpin.Flag("collect.exclude", "Regex of cgroup names to skip, matched against the whole name before it is renamed").Default("").String()
+	SysRoot            = kingpin.Flag("path.sys.root", "Root path to sys fs, used to resolve block device names").Default(defSysRoot).String()
 	metricLock         = sync.RWMutex{}
 )
 
@@ -39,22 +54,47 @@ const (
 	Namespace     = "cgroup"
 	defCgroupRoot = "/sys/fs/cgroup"
 	defProcRoot   = "/proc"
+	defSysRoot    = "/sys"
+	// Reasons for cgroup_exporter_collect_errors_total, kept to a bounded set
+	reasonLoadFailed        = "load_failed"
+	reasonStatFailed        = "stat_failed"
+	reasonMemoryStatMissing = "memory_stat_missing"
+	reasonPidsUnavailable   = "pids_unavailable"
+	reasonProcUnreadable    = "proc_unreadable"
+	reasonTimeout           = "timeout"
+	defMemoryStat           = "anon,file,kernel_stack,slab_reclaimable,slab_unreclaimable,sock,shmem,file_mapped,file_dirty,file_writeback," +
+		"pgfault,pgmajfault,workingset_refault_anon,workingset_refault_file," +
+		"total_cache,total_rss,total_shmem,total_mapped_file,total_dirty,total_writeback,total_pgfault,total_pgmajfault"
+	defNumaStat = "total,anon,file,unevictable,kernel_stack,shmem,file_mapped,file_dirty,file_writeback,slab_reclaimable,slab_unreclaimable"
 )
 
 type Collector interface {
 	// Get new metrics and expose them via prometheus registry.
 	Describe(ch chan<- *prometheus.Desc)
 	Collect(ch chan<- prometheus.Metric)
+	// Return a collector that stops collecting when ctx is done.
+	WithContext(ctx context.Context) prometheus.Collector
+	// Replace the configuration used by future collections.
+	SetConfig(config *Config)
 }
 
 type Exporter struct {
-	paths           []string
+	paths           []PathConfig
+	pathsLock       sync.RWMutex
 	collectError    *prometheus.Desc
 	cpuUser         *prometheus.Desc
 	cpuSystem       *prometheus.Desc
 	cpuTotal        *prometheus.Desc
 	cpus            *prometheus.Desc
+	cpusEffective   *prometheus.Desc
 	cpu_info        *prometheus.Desc
+	cpuPeriods      *prometheus.Desc
+	cpuThrottled    *prometheus.Desc
+	cpuThrottledSec *prometheus.Desc
+	cpuQuota        *prometheus.Desc
+	cpuPeriod       *prometheus.Desc
+	cpuQuotaCores   *prometheus.Desc
+	cpuEfficiency   *prometheus.Desc
 	memoryRSS       *prometheus.Desc
 	memoryCache     *prometheus.Desc
 	memoryUsed      *prometheus.Desc
@@ -65,10 +105,112 @@ type Exporter struct {
 	memswFailCount  *prometheus.Desc
 	info            *prometheus.Desc
 	processExec     *prometheus.Desc
+	pressureAvg10   *prometheus.Desc
+	pressureAvg60   *prometheus.Desc
+	pressureAvg300  *prometheus.Desc
+	pressureStall   *prometheus.Desc
+	ioReadBytes     *prometheus.Desc
+	ioWriteBytes    *prometheus.Desc
+	ioReadOps       *prometheus.Desc
+	ioWriteOps      *prometheus.Desc
+	memoryStat      *prometheus.Desc
+	memoryEvents    *prometheus.Desc
+	memswEvents     *prometheus.Desc
+	memoryHigh      *prometheus.Desc
+	memoryLow       *prometheus.Desc
+	memoryMin       *prometheus.Desc
+	memoryPeak      *prometheus.Desc
+	pidsCurrent     *prometheus.Desc
+	pidsMax         *prometheus.Desc
+	pidsEventsMax   *prometheus.Desc
+	memoryNuma      *prometheus.Desc
+	hugetlbUsage    *prometheus.Desc
+	hugetlbLimit    *prometheus.Desc
+	hugetlbFailCnt  *prometheus.Desc
+	memoryStatKeys  map[string]bool
+	numaStatKeys    map[string]bool
+	cpuSamples      map[string]cpuSample
+	cpuSamplesLock  sync.Mutex
+	snapshotAge     *prometheus.Desc
+	collectDuration *prometheus.Desc
+	snapshot        *snapshot
+	snapshotLock    sync.RWMutex
+	inflight        *inflight
+	inflightLock    sync.Mutex
+	coalesced       *prometheus.Desc
+	coalescedTotal  atomic.Uint64
+	pathDuration    *prometheus.Desc
+	pathCgroups     *prometheus.Desc
+	pathProcesses   *prometheus.Desc
+	pidErrors       *prometheus.Desc
+	procsErrors     *prometheus.Desc
+	pidErrorCount   map[string]float64
+	pidErrorsLock   sync.Mutex
+	collectErrors   *prometheus.Desc
+	errorCount      map[string]float64
+	errorCountLock  sync.Mutex
+	workerWait      prometheus.Histogram
+	pool            *workerPool
+	collectInterval time.Duration
 	logger          *slog.Logger
 	cgroupv2        bool
 }
 
+type snapshot struct {
+	metrics    []CgroupMetric
+	paths      []pathStat
+	efficiency map[string]float64
+	time       time.Time
+	duration   float64
+}
+
+// workerPool limits the number of cgroups and processes read at the same time
+// and records how long work waited for a free worker
+type workerPool struct {
+	slots chan struct{}
+	wait  prometheus.Observer
+}
+
+// pidIndex maps discovered cgroup names to their PIDs, names are kept in the order discovered
+type pidIndex struct {
+	names []string
+	pids  map[string][]int
+	seen  map[int]bool
+}
+
+// pathStat describes the collection of a single configured path
+type pathStat struct {
+	path      string
+	duration  float64
+	cgroups   int
+	processes int
+	pidErrors int
+	procsErrs int
+}
+
+// inflight is a collection in progress that concurrent scrapes wait on
+type inflight struct {
+	done chan struct{}
+	s    *snapshot
+}
+
+// contextCollector collects from an Exporter bound by the context of a single scrape
+type contextCollector struct {
+	e   *Exporter
+	ctx context.Context
+}
+
+type metricResult struct {
+	name   string
+	metric CgroupMetric
+	ok     bool
+}
+
+type cpuSample struct {
+	total float64
+	time  time.Time
+}
+
 type CgroupMetric struct {
 	name            string
 	cpuUser         float64
@@ -76,11 +218,21 @@ type CgroupMetric struct {
 	cpuTotal        float64
 	cpus            int
 	cpu_list        string
+	cpusEffective   int
+	cpu_effective   string
+	mems_list       string
+	cpuPeriods      float64
+	cpuThrottled    float64
+	cpuThrottledSec float64
+	cpuQuota        float64
+	cpuPeriod       float64
+	cpuQuotaCores   float64
 	memoryRSS       float64
 	memoryCache     float64
 	memoryUsed      float64
 	memoryTotal     float64
 	memoryFailCount float64
+	memoryValues    map[string]float64
 	memswUsed       float64
 	memswTotal      float64
 	memswFailCount  float64
@@ -90,22 +242,102 @@ type CgroupMetric struct {
 	username        string
 	jobid           string
 	processExec     map[string]float64
+	pressure        []pressureStat
+	io              []ioStat
+	hugetlb         []hugetlbStat
+	numa            []numaStat
+	memoryStat      map[string]float64
+	memoryEvents    map[string]float64
+	memswEvents     map[string]float64
+	pids            bool
+	pidsCurrent     float64
+	pidsMax         float64
+	pidsEventsMax   float64
 	err             bool
+	errReason       string
+	failed          bool
+	groups          map[string]bool
+}
+
+// collects returns if the metric group is collected, all groups are collected when none are configured
+func (m *CgroupMetric) collects(group string) bool {
+	return m.groups == nil || m.groups[group]
+}
+
+// pathError returns a metric marking a configured path that could not be collected
+func pathError(path string, reason string) CgroupMetric {
+	metric := CgroupMetric{name: path}
+	metric.setFailed(reason)
+	return metric
+}
+
+// setError marks the metric as failed, the first reason is kept
+func (m *CgroupMetric) setError(reason string) {
+	m.err = true
+	if m.errReason == "" {
+		m.errReason = reason
+	}
+}
+
+// setFailed marks the metric as failed before its values were read, only collect_error is exported for it
+func (m *CgroupMetric) setFailed(reason string) {
+	m.setError(reason)
+	m.failed = true
+}
+
+type pressureStat struct {
+	resource string
+	kind     string
+	avg10    float64
+	avg60    float64
+	avg300   float64
+	total    float64
 }
 
-func NewCgroupCollector(cgroupV2 bool, paths []string, logger *slog.Logger) Collector {
-	var collector Collector
+type numaStat struct {
+	node  string
+	kind  string
+	bytes float64
+}
+
+type hugetlbStat struct {
+	pagesize string
+	usage    float64
+	limit    float64
+	failcnt  float64
+}
+
+type ioStat struct {
+	device     string
+	readBytes  float64
+	writeBytes float64
+	readOps    float64
+	writeOps   float64
+}
+
+func NewCgroupCollector(cgroupV2 bool, config *Config, logger *slog.Logger) Collector {
+	var exporter *Exporter
 	if cgroupV2 {
-		collector = NewCgroupV2Collector(paths, logger)
+		exporter = NewCgroupV2Collector(config, logger)
 	} else {
-		collector = NewCgroupV1Collector(paths, logger)
+		exporter = NewCgroupV1Collector(config, logger)
+	}
+	if exporter.collectInterval > 0 {
+		go exporter.collectLoop(nil)
 	}
-	return collector
+	return exporter
 }
 
-func NewExporter(paths []string, logger *slog.Logger, cgroupv2 bool) *Exporter {
+func NewExporter(config *Config, logger *slog.Logger, cgroupv2 bool) *Exporter {
+	workerWait := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "exporter",
+		Name:      "worker_wait_seconds",
+		Help:      "Time cgroup and process reads waited for a free worker",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 10, 6),
+	})
 	return &Exporter{
-		paths: paths,
+		paths: config.Paths,
 		cpuUser: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "cpu", "user_seconds"),
 			"Cumalitive CPU user seconds for cgroup", []string{"cgroup"}, nil),
 		cpuSystem: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "cpu", "system_seconds"),
@@ -114,8 +346,24 @@ func NewExporter(paths []string, logger *slog.Logger, cgroupv2 bool) *Exporter {
 			"Cumalitive CPU total seconds for cgroup", []string{"cgroup"}, nil),
 		cpus: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "", "cpus"),
 			"Number of CPUs in the cgroup", []string{"cgroup"}, nil),
+		cpusEffective: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "", "cpus_effective"),
+			"Number of effective CPUs in the cgroup", []string{"cgroup"}, nil),
 		cpu_info: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "", "cpu_info"),
-			"Information about the cgroup CPUs", []string{"cgroup", "cpus"}, nil),
+			"Information about the cgroup CPUs", []string{"cgroup", "cpus", "effective_cpus", "mems"}, nil),
+		cpuPeriods: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "cpu", "cfs_periods_total"),
+			"Number of elapsed CFS enforcement periods", []string{"cgroup"}, nil),
+		cpuThrottled: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "cpu", "cfs_throttled_periods_total"),
+			"Number of CFS enforcement periods where cgroup was throttled", []string{"cgroup"}, nil),
+		cpuThrottledSec: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "cpu", "cfs_throttled_seconds_total"),
+			"Total time cgroup was throttled in seconds", []string{"cgroup"}, nil),
+		cpuQuota: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "cpu", "cfs_quota_seconds"),
+			"CPU time cgroup may use each CFS period in seconds", []string{"cgroup"}, nil),
+		cpuPeriod: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "cpu", "cfs_period_seconds"),
+			"Length of CFS enforcement period in seconds", []string{"cgroup"}, nil),
+		cpuQuotaCores: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "cpu", "quota_cores"),
+			"Number of CPUs allocated to cgroup by CFS quota", []string{"cgroup"}, nil),
+		cpuEfficiency: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "cpu", "efficiency_ratio"),
+			"CPU usage since previous collection divided by allocated CPUs", []string{"cgroup"}, nil),
 		memoryRSS: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "memory", "rss_bytes"),
 			"Memory RSS used in bytes", []string{"cgroup"}, nil),
 		memoryCache: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "memory", "cache_bytes"),
@@ -126,6 +374,14 @@ func NewExporter(paths []string, logger *slog.Logger, cgroupv2 bool) *Exporter {
 			"Memory total given to cgroup in bytes", []string{"cgroup"}, nil),
 		memoryFailCount: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "memory", "fail_count"),
 			"Memory fail count", []string{"cgroup"}, nil),
+		memoryHigh: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "memory", "high_bytes"),
+			"Memory usage throttle limit in bytes", []string{"cgroup"}, nil),
+		memoryLow: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "memory", "low_bytes"),
+			"Memory best-effort protection in bytes", []string{"cgroup"}, nil),
+		memoryMin: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "memory", "min_bytes"),
+			"Memory hard protection in bytes", []string{"cgroup"}, nil),
+		memoryPeak: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "memory", "peak_bytes"),
+			"Maximum memory used in bytes", []string{"cgroup"}, nil),
 		memswUsed: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "memsw", "used_bytes"),
 			"Swap used in bytes", []string{"cgroup"}, nil),
 		memswTotal: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "memsw", "total_bytes"),
@@ -138,8 +394,77 @@ func NewExporter(paths []string, logger *slog.Logger, cgroupv2 bool) *Exporter {
 			"Count of instances of a given process", []string{"cgroup", "exec"}, nil),
 		collectError: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "exporter", "collect_error"),
 			"Indicates collection error, 0=no error, 1=error", []string{"cgroup"}, nil),
-		logger:   logger,
-		cgroupv2: cgroupv2,
+		pressureAvg10: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "pressure", "avg10"),
+			"Percentage of time tasks were stalled on resource over last 10 seconds", []string{"cgroup", "resource", "kind"}, nil),
+		pressureAvg60: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "pressure", "avg60"),
+			"Percentage of time tasks were stalled on resource over last 60 seconds", []string{"cgroup", "resource", "kind"}, nil),
+		pressureAvg300: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "pressure", "avg300"),
+			"Percentage of time tasks were stalled on resource over last 300 seconds", []string{"cgroup", "resource", "kind"}, nil),
+		pressureStall: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "pressure", "stall_seconds_total"),
+			"Total time tasks were stalled on resource in seconds", []string{"cgroup", "resource", "kind"}, nil),
+		ioReadBytes: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "io", "read_bytes_total"),
+			"Total bytes read from block device", []string{"cgroup", "device"}, nil),
+		ioWriteBytes: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "io", "write_bytes_total"),
+			"Total bytes written to block device", []string{"cgroup", "device"}, nil),
+		ioReadOps: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "io", "read_ops_total"),
+			"Total read operations on block device", []string{"cgroup", "device"}, nil),
+		ioWriteOps: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "io", "write_ops_total"),
+			"Total write operations on block device", []string{"cgroup", "device"}, nil),
+		memoryStat: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "memory", "stat"),
+			"Memory statistics from memory.stat", []string{"cgroup", "stat"}, nil),
+		memoryEvents: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "memory", "events_total"),
+			"Memory events from memory.events", []string{"cgroup", "event"}, nil),
+		memswEvents: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "memsw", "events_total"),
+			"Swap events from memory.swap.events", []string{"cgroup", "event"}, nil),
+		pidsCurrent: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "pids", "current"),
+			"Number of processes in the cgroup", []string{"cgroup"}, nil),
+		pidsMax: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "pids", "max"),
+			"Maximum number of processes allowed in the cgroup", []string{"cgroup"}, nil),
+		pidsEventsMax: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "pids", "events_max_total"),
+			"Number of times fork failed because the cgroup hit pids.max", []string{"cgroup"}, nil),
+		memoryNuma: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "memory", "numa_bytes"),
+			"Memory used on each NUMA node in bytes", []string{"cgroup", "node", "type"}, nil),
+		hugetlbUsage: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "hugetlb", "usage_bytes"),
+			"Huge page usage in bytes", []string{"cgroup", "pagesize"}, nil),
+		hugetlbLimit: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "hugetlb", "limit_bytes"),
+			"Huge page limit in bytes", []string{"cgroup", "pagesize"}, nil),
+		hugetlbFailCnt: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "hugetlb", "failcnt_total"),
+			"Number of huge page allocations that failed due to limit", []string{"cgroup", "pagesize"}, nil),
+		memoryStatKeys: statKeys(*collectMemoryStat),
+		numaStatKeys:   statKeys(*collectNumaStat),
+		cpuSamples:     make(map[string]cpuSample),
+		snapshotAge: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "exporter", "snapshot_age_seconds"),
+			"Age of the background collection snapshot served on scrape", nil, nil),
+		collectDuration: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "exporter", "snapshot_duration_seconds"),
+			"Time taken by the background collection that produced the snapshot", nil, nil),
+		coalesced: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "exporter", "scrapes_coalesced_total"),
+			"Number of scrapes that shared the result of a collection already in progress", nil, nil),
+		pathDuration: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "exporter", "collect_duration_seconds"),
+			"Time taken to collect the cgroups of a configured path", []string{"path"}, nil),
+		pathCgroups: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "exporter", "discovered_cgroups"),
+			"Number of cgroups discovered under a configured path", []string{"path"}, nil),
+		pathProcesses: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "exporter", "discovered_processes"),
+			"Number of processes discovered under a configured path", []string{"path"}, nil),
+		pidErrors: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "exporter", "pid_lookup_errors_total"),
+			"Number of failures mapping processes to their cgroup", []string{"path"}, nil),
+		procsErrors: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "exporter", "procs_read_errors_total"),
+			"Number of cgroup.procs files that could not be read", []string{"path"}, nil),
+		collectErrors: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "exporter", "collect_errors_total"),
+			"Number of cgroups that failed to be collected by reason", []string{"reason"}, nil),
+		errorCount: map[string]float64{
+			reasonLoadFailed:        0,
+			reasonStatFailed:        0,
+			reasonMemoryStatMissing: 0,
+			reasonPidsUnavailable:   0,
+			reasonProcUnreadable:    0,
+			reasonTimeout:           0,
+		},
+		workerWait:      workerWait,
+		pool:            newWorkerPool(*collectConcurrency, workerWait),
+		pidErrorCount:   make(map[string]float64),
+		collectInterval: *collectInterval,
+		logger:          logger,
+		cgroupv2:        cgroupv2,
 	}
 }
 
@@ -148,81 +473,560 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- e.cpuSystem
 	ch <- e.cpuTotal
 	ch <- e.cpus
+	ch <- e.cpusEffective
 	ch <- e.cpu_info
+	ch <- e.cpuPeriods
+	ch <- e.cpuThrottled
+	ch <- e.cpuThrottledSec
+	ch <- e.cpuQuota
+	ch <- e.cpuPeriod
+	ch <- e.cpuQuotaCores
+	ch <- e.cpuEfficiency
 	ch <- e.memoryRSS
 	ch <- e.memoryCache
 	ch <- e.memoryUsed
 	ch <- e.memoryTotal
 	ch <- e.memoryFailCount
+	ch <- e.memoryLow
+	ch <- e.memoryPeak
 	ch <- e.memswUsed
 	ch <- e.memswTotal
 	ch <- e.memswFailCount
 	ch <- e.info
-	if *collectProc {
-		ch <- e.processExec
+	ch <- e.ioReadBytes
+	ch <- e.ioWriteBytes
+	ch <- e.ioReadOps
+	ch <- e.ioWriteOps
+	ch <- e.memoryStat
+	ch <- e.pidsCurrent
+	ch <- e.pidsMax
+	ch <- e.pidsEventsMax
+	ch <- e.memoryNuma
+	ch <- e.hugetlbUsage
+	ch <- e.hugetlbLimit
+	ch <- e.hugetlbFailCnt
+	ch <- e.coalesced
+	ch <- e.pathDuration
+	ch <- e.pathCgroups
+	ch <- e.pathProcesses
+	ch <- e.pidErrorsDesc()
+	ch <- e.collectErrors
+	ch <- e.workerWait.Desc()
+	if e.cgroupv2 {
+		ch <- e.memoryHigh
+		ch <- e.memoryMin
+		ch <- e.memoryEvents
+		ch <- e.memswEvents
+		ch <- e.pressureAvg10
+		ch <- e.pressureAvg60
+		ch <- e.pressureAvg300
+		ch <- e.pressureStall
+	}
+	paths := e.getPaths()
+	for i := range paths {
+		if paths[i].proc() {
+			ch <- e.processExec
+			break
+		}
+	}
+	if e.collectInterval > 0 {
+		ch <- e.snapshotAge
+		ch <- e.collectDuration
 	}
 }
 
-func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+func (e *Exporter) collect(ctx context.Context) *snapshot {
+	start := time.Now()
 	var metrics []CgroupMetric
+	var paths []pathStat
+	if e.cgroupv2 {
+		metrics, paths, _ = e.collectv2(ctx)
+	} else {
+		metrics, paths, _ = e.collectv1(ctx)
+	}
+	metrics = e.dropDuplicates(metrics)
+	e.pidErrorsLock.Lock()
+	collected := make(map[string]bool)
+	for _, p := range paths {
+		e.pidErrorCount[p.path] += float64(p.pidErrors + p.procsErrs)
+		collected[p.path] = true
+	}
+	// Drop counters of paths no longer collected, such as glob matches that were removed
+	for path := range e.pidErrorCount {
+		if !collected[path] {
+			delete(e.pidErrorCount, path)
+		}
+	}
+	e.pidErrorsLock.Unlock()
+	e.errorCountLock.Lock()
+	for _, m := range metrics {
+		if m.err {
+			e.errorCount[m.errReason]++
+		}
+	}
+	e.errorCountLock.Unlock()
+	return &snapshot{
+		metrics:    metrics,
+		paths:      paths,
+		efficiency: e.getCPUEfficiency(metrics, time.Now()),
+		time:       start,
+		duration:   time.Since(start).Seconds(),
+	}
+}
+
+// pidErrorsDesc returns the metric for failures finding the processes of a path. Cgroup v1 maps each process
+// to its cgroup, cgroup v2 reads the processes of each cgroup from cgroup.procs so failures are per cgroup.
+func (e *Exporter) pidErrorsDesc() *prometheus.Desc {
 	if e.cgroupv2 {
-		metrics, _ = e.collectv2()
+		return e.procsErrors
+	}
+	return e.pidErrors
+}
+
+// dropDuplicates keeps the first metric for each cgroup name, a name collected twice would fail the whole scrape.
+// Duplicates come from renames that map several cgroups to one name or from paths that overlap.
+func (e *Exporter) dropDuplicates(metrics []CgroupMetric) []CgroupMetric {
+	seen := make(map[string]bool, len(metrics))
+	unique := metrics[:0]
+	for _, m := range metrics {
+		if seen[m.name] {
+			e.logger.Error("Dropping cgroup collected more than once, check rename and paths configuration", "cgroup", m.name)
+			continue
+		}
+		seen[m.name] = true
+		unique = append(unique, m)
+	}
+	return unique
+}
+
+// collectShared runs a collection or, when one is already in progress, waits for it and returns its result.
+// The collection ends at the deadline of the scrape that started it but is not cancelled when that scrape goes away,
+// scrapes that wait on it stop waiting when their own ctx is done.
+func (e *Exporter) collectShared(ctx context.Context) *snapshot {
+	e.inflightLock.Lock()
+	if c := e.inflight; c != nil {
+		e.inflightLock.Unlock()
+		e.coalescedTotal.Add(1)
+		e.logger.Debug("Waiting on collection already in progress")
+		select {
+		case <-c.done:
+			return c.s
+		case <-ctx.Done():
+			e.logger.Error("Timeout waiting on collection in progress", "err", ctx.Err())
+			return e.timeoutSnapshot()
+		}
+	}
+	c := &inflight{done: make(chan struct{})}
+	e.inflight = c
+	e.inflightLock.Unlock()
+	defer func() {
+		e.inflightLock.Lock()
+		e.inflight = nil
+		e.inflightLock.Unlock()
+		close(c.done)
+	}()
+	collectCtx := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		collectCtx, cancel = context.WithDeadline(collectCtx, deadline)
+		defer cancel()
+	}
+	c.s = e.collect(collectCtx)
+	return c.s
+}
+
+// timeoutSnapshot marks every configured path as timed out for a scrape that stopped waiting,
+// errorCount is left to the collection in progress so its cgroups are not counted twice
+func (e *Exporter) timeoutSnapshot() *snapshot {
+	var metrics []CgroupMetric
+	for _, p := range e.getPaths() {
+		metrics = append(metrics, pathError(p.Path, reasonTimeout))
+	}
+	return &snapshot{metrics: metrics, time: time.Now()}
+}
+
+// collectLoop collects metrics every collectInterval until done is closed
+func (e *Exporter) collectLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(e.collectInterval)
+	defer ticker.Stop()
+	for {
+		s := e.collectShared(context.Background())
+		e.logger.Debug("Background collection complete", "cgroups", len(s.metrics), "duration", s.duration)
+		e.snapshotLock.Lock()
+		e.snapshot = s
+		e.snapshotLock.Unlock()
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SetConfig replaces the configured paths, the config must already be validated
+func (e *Exporter) SetConfig(config *Config) {
+	e.pathsLock.Lock()
+	e.paths = config.Paths
+	e.pathsLock.Unlock()
+}
+
+// getPaths returns the paths to collect, the returned slice is never modified
+func (e *Exporter) getPaths() []PathConfig {
+	e.pathsLock.RLock()
+	defer e.pathsLock.RUnlock()
+	return e.paths
+}
+
+// expandPaths replaces glob and regex paths with the cgroups they currently match.
+// Matches that are, or are nested under, a plain path or an earlier match are dropped
+// because their processes are already collected.
+func (e *Exporter) expandPaths(paths []PathConfig) []PathConfig {
+	root := *CgroupRoot
+	if !e.cgroupv2 {
+		root = filepath.Join(*CgroupRoot, "cpuacct")
+	}
+	var collected []string
+	for _, p := range paths {
+		if !p.pattern() {
+			collected = append(collected, p.group(e.cgroupv2))
+		}
+	}
+	var expanded []PathConfig
+	for _, p := range paths {
+		if !p.pattern() {
+			expanded = append(expanded, p)
+			continue
+		}
+		matches, err := p.expand(root)
+		if err != nil {
+			e.logger.Error("Error expanding path", "path", p.Path, "root", root, "err", err)
+			continue
+		}
+		e.logger.Debug("Expanded path", "path", p.Path, "matches", len(matches))
+		for _, match := range matches {
+			if parent := nestedUnder(match, collected); parent != "" {
+				e.logger.Debug("Skip match already collected", "path", p.Path, "match", match, "parent", parent)
+				continue
+			}
+			collected = append(collected, match)
+			pc := p
+			pc.Path = match
+			pc.glob = false
+			pc.regex = nil
+			expanded = append(expanded, pc)
+		}
+	}
+	return expanded
+}
+
+// nestedUnder returns the cgroup of parents that path is equal to or nested under, or an empty string
+func nestedUnder(path string, parents []string) string {
+	for _, parent := range parents {
+		if path == parent || strings.HasPrefix(path, strings.TrimSuffix(parent, "/")+"/") {
+			return parent
+		}
+	}
+	return ""
+}
+
+func (e *Exporter) WithContext(ctx context.Context) prometheus.Collector {
+	return &contextCollector{e: e, ctx: ctx}
+}
+
+func (c *contextCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.e.Describe(ch)
+}
+
+func (c *contextCollector) Collect(ch chan<- prometheus.Metric) {
+	c.e.collectContext(c.ctx, ch)
+}
+
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.collectContext(context.Background(), ch)
+}
+
+// collectContext sends metrics to ch, cgroups not collected before ctx is done are marked with collect_error
+func (e *Exporter) collectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	var s *snapshot
+	if e.collectInterval > 0 {
+		e.snapshotLock.RLock()
+		s = e.snapshot
+		e.snapshotLock.RUnlock()
+	}
+	if s != nil {
+		ch <- prometheus.MustNewConstMetric(e.snapshotAge, prometheus.GaugeValue, time.Since(s.time).Seconds())
+		ch <- prometheus.MustNewConstMetric(e.collectDuration, prometheus.GaugeValue, s.duration)
 	} else {
-		metrics, _ = e.collectv1()
+		// Collect live when not running in the background or before the first background collection completes
+		s = e.collectShared(ctx)
+	}
+	ch <- prometheus.MustNewConstMetric(e.coalesced, prometheus.CounterValue, float64(e.coalescedTotal.Load()))
+	for _, p := range s.paths {
+		ch <- prometheus.MustNewConstMetric(e.pathDuration, prometheus.GaugeValue, p.duration, p.path)
+		ch <- prometheus.MustNewConstMetric(e.pathCgroups, prometheus.GaugeValue, float64(p.cgroups), p.path)
+		ch <- prometheus.MustNewConstMetric(e.pathProcesses, prometheus.GaugeValue, float64(p.processes), p.path)
+	}
+	pidErrors := e.pidErrorsDesc()
+	e.pidErrorsLock.Lock()
+	for path, count := range e.pidErrorCount {
+		ch <- prometheus.MustNewConstMetric(pidErrors, prometheus.CounterValue, count, path)
 	}
+	e.pidErrorsLock.Unlock()
+	e.errorCountLock.Lock()
+	for reason, count := range e.errorCount {
+		ch <- prometheus.MustNewConstMetric(e.collectErrors, prometheus.CounterValue, count, reason)
+	}
+	e.errorCountLock.Unlock()
+	ch <- e.workerWait
+	metrics := s.metrics
+	efficiency := s.efficiency
 
 	for _, m := range metrics {
+		var collectError float64
 		if m.err {
-			ch <- prometheus.MustNewConstMetric(e.collectError, prometheus.GaugeValue, 1, m.name)
-		}
-		ch <- prometheus.MustNewConstMetric(e.cpuUser, prometheus.CounterValue, m.cpuUser, m.name)
-		ch <- prometheus.MustNewConstMetric(e.cpuSystem, prometheus.CounterValue, m.cpuSystem, m.name)
-		ch <- prometheus.MustNewConstMetric(e.cpuTotal, prometheus.CounterValue, m.cpuTotal, m.name)
-		ch <- prometheus.MustNewConstMetric(e.cpus, prometheus.GaugeValue, float64(m.cpus), m.name)
-		ch <- prometheus.MustNewConstMetric(e.cpu_info, prometheus.GaugeValue, 1, m.name, m.cpu_list)
-		ch <- prometheus.MustNewConstMetric(e.memoryRSS, prometheus.GaugeValue, m.memoryRSS, m.name)
-		ch <- prometheus.MustNewConstMetric(e.memoryUsed, prometheus.GaugeValue, m.memoryUsed, m.name)
-		ch <- prometheus.MustNewConstMetric(e.memoryTotal, prometheus.GaugeValue, m.memoryTotal, m.name)
-		ch <- prometheus.MustNewConstMetric(e.memoryCache, prometheus.GaugeValue, m.memoryCache, m.name)
-		ch <- prometheus.MustNewConstMetric(e.memoryFailCount, prometheus.GaugeValue, m.memoryFailCount, m.name)
-		ch <- prometheus.MustNewConstMetric(e.memswUsed, prometheus.GaugeValue, m.memswUsed, m.name)
-		ch <- prometheus.MustNewConstMetric(e.memswTotal, prometheus.GaugeValue, m.memswTotal, m.name)
-		// These metrics currently have no cgroup v2 information
-		if !e.cgroupv2 {
+			collectError = 1
+		}
+		ch <- prometheus.MustNewConstMetric(e.collectError, prometheus.GaugeValue, collectError, m.name)
+		// Zero values would look like counter resets
+		if m.failed {
+			continue
+		}
+		if m.collects(groupCPU) {
+			ch <- prometheus.MustNewConstMetric(e.cpuUser, prometheus.CounterValue, m.cpuUser, m.name)
+			ch <- prometheus.MustNewConstMetric(e.cpuSystem, prometheus.CounterValue, m.cpuSystem, m.name)
+			ch <- prometheus.MustNewConstMetric(e.cpuTotal, prometheus.CounterValue, m.cpuTotal, m.name)
+			ch <- prometheus.MustNewConstMetric(e.cpus, prometheus.GaugeValue, float64(m.cpus), m.name)
+			ch <- prometheus.MustNewConstMetric(e.cpusEffective, prometheus.GaugeValue, float64(m.cpusEffective), m.name)
+			ch <- prometheus.MustNewConstMetric(e.cpu_info, prometheus.GaugeValue, 1, m.name, m.cpu_list, m.cpu_effective, m.mems_list)
+			ch <- prometheus.MustNewConstMetric(e.cpuPeriods, prometheus.CounterValue, m.cpuPeriods, m.name)
+			ch <- prometheus.MustNewConstMetric(e.cpuThrottled, prometheus.CounterValue, m.cpuThrottled, m.name)
+			ch <- prometheus.MustNewConstMetric(e.cpuThrottledSec, prometheus.CounterValue, m.cpuThrottledSec, m.name)
+			if val, ok := efficiency[m.name]; ok {
+				ch <- prometheus.MustNewConstMetric(e.cpuEfficiency, prometheus.GaugeValue, val, m.name)
+			}
+			if m.cpuPeriod > 0 {
+				ch <- prometheus.MustNewConstMetric(e.cpuPeriod, prometheus.GaugeValue, m.cpuPeriod, m.name)
+				// A negative quota means the cgroup is not limited by CFS quota
+				if m.cpuQuota >= 0 {
+					ch <- prometheus.MustNewConstMetric(e.cpuQuota, prometheus.GaugeValue, m.cpuQuota, m.name)
+					ch <- prometheus.MustNewConstMetric(e.cpuQuotaCores, prometheus.GaugeValue, m.cpuQuotaCores, m.name)
+				}
+			}
+		}
+		if m.collects(groupMemory) {
+			ch <- prometheus.MustNewConstMetric(e.memoryRSS, prometheus.GaugeValue, m.memoryRSS, m.name)
+			ch <- prometheus.MustNewConstMetric(e.memoryUsed, prometheus.GaugeValue, m.memoryUsed, m.name)
+			ch <- prometheus.MustNewConstMetric(e.memoryTotal, prometheus.GaugeValue, m.memoryTotal, m.name)
+			ch <- prometheus.MustNewConstMetric(e.memoryCache, prometheus.GaugeValue, m.memoryCache, m.name)
+			ch <- prometheus.MustNewConstMetric(e.memoryFailCount, prometheus.GaugeValue, m.memoryFailCount, m.name)
+			// Only values that were read are exported, memory.peak is missing before Linux 5.19
+			for key, desc := range map[string]*prometheus.Desc{
+				"high": e.memoryHigh,
+				"low":  e.memoryLow,
+				"min":  e.memoryMin,
+				"peak": e.memoryPeak,
+			} {
+				if value, ok := m.memoryValues[key]; ok {
+					ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, m.name)
+				}
+			}
+			ch <- prometheus.MustNewConstMetric(e.memswUsed, prometheus.GaugeValue, m.memswUsed, m.name)
+			ch <- prometheus.MustNewConstMetric(e.memswTotal, prometheus.GaugeValue, m.memswTotal, m.name)
 			ch <- prometheus.MustNewConstMetric(e.memswFailCount, prometheus.GaugeValue, m.memswFailCount, m.name)
+			for event, value := range m.memoryEvents {
+				ch <- prometheus.MustNewConstMetric(e.memoryEvents, prometheus.CounterValue, value, m.name, event)
+			}
+			for event, value := range m.memswEvents {
+				ch <- prometheus.MustNewConstMetric(e.memswEvents, prometheus.CounterValue, value, m.name, event)
+			}
+			for stat, value := range m.memoryStat {
+				ch <- prometheus.MustNewConstMetric(e.memoryStat, prometheus.GaugeValue, value, m.name, stat)
+			}
+		}
+		if m.pids && m.collects(groupPids) {
+			ch <- prometheus.MustNewConstMetric(e.pidsCurrent, prometheus.GaugeValue, m.pidsCurrent, m.name)
+			// A negative limit means the number of processes is not limited
+			if m.pidsMax >= 0 {
+				ch <- prometheus.MustNewConstMetric(e.pidsMax, prometheus.GaugeValue, m.pidsMax, m.name)
+			}
+			ch <- prometheus.MustNewConstMetric(e.pidsEventsMax, prometheus.CounterValue, m.pidsEventsMax, m.name)
+		}
+		if m.collects(groupNuma) {
+			for _, n := range m.numa {
+				ch <- prometheus.MustNewConstMetric(e.memoryNuma, prometheus.GaugeValue, n.bytes, m.name, n.node, n.kind)
+			}
+		}
+		if m.collects(groupHugetlb) {
+			for _, h := range m.hugetlb {
+				ch <- prometheus.MustNewConstMetric(e.hugetlbUsage, prometheus.GaugeValue, h.usage, m.name, h.pagesize)
+				ch <- prometheus.MustNewConstMetric(e.hugetlbLimit, prometheus.GaugeValue, h.limit, m.name, h.pagesize)
+				ch <- prometheus.MustNewConstMetric(e.hugetlbFailCnt, prometheus.CounterValue, h.failcnt, m.name, h.pagesize)
+			}
+		}
+		if m.collects(groupIO) {
+			for _, i := range m.io {
+				ch <- prometheus.MustNewConstMetric(e.ioReadBytes, prometheus.CounterValue, i.readBytes, m.name, i.device)
+				ch <- prometheus.MustNewConstMetric(e.ioWriteBytes, prometheus.CounterValue, i.writeBytes, m.name, i.device)
+				ch <- prometheus.MustNewConstMetric(e.ioReadOps, prometheus.CounterValue, i.readOps, m.name, i.device)
+				ch <- prometheus.MustNewConstMetric(e.ioWriteOps, prometheus.CounterValue, i.writeOps, m.name, i.device)
+			}
+		}
+		if m.collects(groupPressure) {
+			for _, p := range m.pressure {
+				ch <- prometheus.MustNewConstMetric(e.pressureAvg10, prometheus.GaugeValue, p.avg10, m.name, p.resource, p.kind)
+				ch <- prometheus.MustNewConstMetric(e.pressureAvg60, prometheus.GaugeValue, p.avg60, m.name, p.resource, p.kind)
+				ch <- prometheus.MustNewConstMetric(e.pressureAvg300, prometheus.GaugeValue, p.avg300, m.name, p.resource, p.kind)
+				ch <- prometheus.MustNewConstMetric(e.pressureStall, prometheus.CounterValue, p.total, m.name, p.resource, p.kind)
+			}
 		}
 		if m.userslice || m.job {
 			ch <- prometheus.MustNewConstMetric(e.info, prometheus.GaugeValue, 1, m.name, m.username, m.uid, m.jobid)
 		}
-		if *collectProc {
-			for exec, count := range m.processExec {
-				ch <- prometheus.MustNewConstMetric(e.processExec, prometheus.GaugeValue, count, m.name, exec)
+		for exec, count := range m.processExec {
+			ch <- prometheus.MustNewConstMetric(e.processExec, prometheus.GaugeValue, count, m.name, exec)
+		}
+	}
+}
+
+// getCPUEfficiency compares CPU usage with the sample from the previous collection
+// and returns the usage as a ratio of allocated CPUs for each cgroup
+func (e *Exporter) getCPUEfficiency(metrics []CgroupMetric, now time.Time) map[string]float64 {
+	efficiency := make(map[string]float64)
+	samples := make(map[string]cpuSample)
+	e.cpuSamplesLock.Lock()
+	defer e.cpuSamplesLock.Unlock()
+	for _, m := range metrics {
+		// CPU usage is still read for cgroups with errors such as proc_unreadable
+		if m.failed || !m.collects("cpu") {
+			continue
+		}
+		samples[m.name] = cpuSample{total: m.cpuTotal, time: now}
+		prev, ok := e.cpuSamples[m.name]
+		if !ok {
+			continue
+		}
+		elapsed := now.Sub(prev.time).Seconds()
+		// Counter reset means the cgroup was recreated
+		if elapsed <= 0 || m.cpuTotal < prev.total {
+			continue
+		}
+		var cores float64
+		if m.cpus > 0 {
+			cores = float64(m.cpus)
+		} else if m.cpusEffective > 0 {
+			cores = float64(m.cpusEffective)
+		} else if m.cpuQuotaCores > 0 {
+			cores = m.cpuQuotaCores
+		} else {
+			continue
+		}
+		efficiency[m.name] = (m.cpuTotal - prev.total) / elapsed / cores
+	}
+	// Only keep samples for cgroups that still exist
+	e.cpuSamples = samples
+	return efficiency
+}
+
+// getMetrics runs get for each name concurrently and returns the metrics completed before ctx is done,
+// names that did not complete in time are returned with err set
+func (e *Exporter) getMetrics(ctx context.Context, names []string, get func(string) (CgroupMetric, bool)) []CgroupMetric {
+	var metrics []CgroupMetric
+	// Buffered so goroutines still running after ctx is done do not block
+	results := make(chan metricResult, len(names))
+	for _, name := range names {
+		go func(n string) {
+			metric, ok := get(n)
+			results <- metricResult{name: n, metric: metric, ok: ok}
+		}(name)
+	}
+	completed := make(map[string]bool)
+	for range names {
+		select {
+		case r := <-results:
+			completed[r.name] = true
+			if r.ok {
+				metrics = append(metrics, r.metric)
 			}
+		case <-ctx.Done():
+			for _, name := range names {
+				if !completed[name] {
+					e.logger.Error("Timeout collecting cgroup", "path", name, "err", ctx.Err())
+					metric := CgroupMetric{name: name}
+					metric.setFailed(reasonTimeout)
+					metrics = append(metrics, metric)
+				}
+			}
+			return metrics
 		}
 	}
+	return metrics
 }
 
-func getProcInfo(pids []int, metric *CgroupMetric, logger *slog.Logger) {
+func newWorkerPool(concurrency int, wait prometheus.Observer) *workerPool {
+	p := &workerPool{wait: wait}
+	if concurrency > 0 {
+		p.slots = make(chan struct{}, concurrency)
+	}
+	return p
+}
+
+// acquire waits for a free worker and returns a function to release it, which is safe to call more than once
+func (p *workerPool) acquire(ctx context.Context) (func(), error) {
+	if p == nil || p.slots == nil {
+		return func() {}, nil
+	}
+	start := time.Now()
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return func() {}, ctx.Err()
+	}
+	p.wait.Observe(time.Since(start).Seconds())
+	once := &sync.Once{}
+	return func() {
+		once.Do(func() { <-p.slots })
+	}, nil
+}
+
+func getProcInfo(ctx context.Context, pool *workerPool, pids []int, metric *CgroupMetric, logger *slog.Logger) {
 	executables := make(map[string]float64)
 	procFS, err := procfs.NewFS(*ProcRoot)
 	if err != nil {
 		logger.Error("Unable to open procfs", "path", *ProcRoot)
+		metric.setError(reasonProcUnreadable)
 		return
 	}
+	var unreadable, incomplete bool
 	wg := &sync.WaitGroup{}
-	wg.Add(len(pids))
 	for _, pid := range pids {
+		release, err := pool.acquire(ctx)
+		if err != nil {
+			logger.Error("Timeout waiting for worker to get process info", "path", metric.name, "err", err)
+			metricLock.Lock()
+			incomplete = true
+			metricLock.Unlock()
+			break
+		}
+		wg.Add(1)
 		go func(p int) {
+			defer wg.Done()
+			defer release()
+			if ctx.Err() != nil {
+				metricLock.Lock()
+				incomplete = true
+				metricLock.Unlock()
+				return
+			}
 			proc, err := procFS.Proc(p)
 			if err != nil {
 				logger.Error("Unable to read PID", "pid", p)
-				wg.Done()
+				procUnreadable(err, &unreadable)
 				return
 			}
 			executable, err := proc.Executable()
 			if err != nil {
 				logger.Error("Unable to get executable for PID", "pid", p)
-				wg.Done()
+				procUnreadable(err, &unreadable)
 				return
 			}
 			if len(executable) > *collectProcMaxExec {
@@ -235,11 +1039,42 @@ func getProcInfo(pids []int, metric *CgroupMetric, logger *slog.Logger) {
 			metricLock.Lock()
 			executables[executable] += 1
 			metricLock.Unlock()
-			wg.Done()
 		}(pid)
 	}
-	wg.Wait()
-	metric.processExec = executables
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		metric.processExec = executables
+	case <-ctx.Done():
+		logger.Error("Timeout getting process info", "path", metric.name, "err", ctx.Err())
+		metric.setError(reasonTimeout)
+		// Copy as goroutines that are still running may update executables
+		metricLock.Lock()
+		metric.processExec = maps.Clone(executables)
+		metricLock.Unlock()
+	}
+	metricLock.Lock()
+	if incomplete {
+		metric.setError(reasonTimeout)
+	}
+	if unreadable {
+		metric.setError(reasonProcUnreadable)
+	}
+	metricLock.Unlock()
+}
+
+// procUnreadable records a failure to read a process, processes that exited while being read are ignored
+func procUnreadable(err error, unreadable *bool) {
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	metricLock.Lock()
+	*unreadable = true
+	metricLock.Unlock()
 }
 
 func parseCpuSet(cpuset string) ([]string, error) {
@@ -293,6 +1128,135 @@ func getCPUs(path string, logger *slog.Logger) ([]string, error) {
 	return cpus, nil
 }
 
+// getQuotaCores returns the number of CPUs a CFS quota in microseconds allows, -1 when there is no quota
+func getQuotaCores(quota int64, period uint64) float64 {
+	if quota < 0 || period == 0 {
+		return -1
+	}
+	return float64(quota) / float64(period)
+}
+
+// getValue reads a single value cgroup file, a value of max is returned as the max uint64
+func getValue(path string) (float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "max" {
+		return math.MaxUint64, nil
+	}
+	v, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return float64(v), nil
+}
+
+func parseStatFile(path string) (map[string]float64, error) {
+	if !fileExists(path) {
+		return nil, fmt.Errorf("path %s does not exist", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stats := make(map[string]float64)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		parts := strings.Fields(s.Text())
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid format in %s: %s", path, s.Text())
+		}
+		v, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value in %s: %s", path, s.Text())
+		}
+		stats[parts[0]] = float64(v)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// statKeys parses a comma separated list of keys to collect, nil means every key is collected
+func statKeys(value string) map[string]bool {
+	if value == "all" {
+		return nil
+	}
+	keys := make(map[string]bool)
+	for _, key := range strings.Split(value, ",") {
+		if key != "" {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// filterNumaStat returns the memory.numa_stat types selected by --collect.memory.numa
+func (e *Exporter) filterNumaStat(numa []numaStat) []numaStat {
+	if e.numaStatKeys == nil {
+		return numa
+	}
+	var filtered []numaStat
+	for _, n := range numa {
+		if e.numaStatKeys[n.kind] {
+			filtered = append(filtered, n)
+		}
+	}
+	return filtered
+}
+
+// filterMemoryStat returns the memory.stat keys selected by --collect.memory.stat
+func (e *Exporter) filterMemoryStat(stats map[string]float64) map[string]float64 {
+	if e.memoryStatKeys == nil {
+		return stats
+	}
+	filtered := make(map[string]float64)
+	for key, value := range stats {
+		if e.memoryStatKeys[key] {
+			filtered[key] = value
+		}
+	}
+	return filtered
+}
+
+// getHugetlbPageSizes returns the huge page sizes with a hugetlb.<size>.<suffix> file in dir
+func getHugetlbPageSizes(dir string, suffix string) []string {
+	var pagesizes []string
+	files, _ := filepath.Glob(filepath.Join(dir, fmt.Sprintf("hugetlb.*.%s", suffix)))
+	for _, file := range files {
+		pagesize := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), "hugetlb."), "."+suffix)
+		// Skip reservation accounting files such as hugetlb.2MB.rsvd.current
+		if strings.Contains(pagesize, ".") {
+			continue
+		}
+		pagesizes = append(pagesizes, pagesize)
+	}
+	return pagesizes
+}
+
+// getBlockDevice resolves a major:minor device number to the kernel device name
+// using /sys/dev/block, falling back to the device number when not resolvable
+func getBlockDevice(majorMinor string) string {
+	link, err := os.Readlink(filepath.Join(*SysRoot, "dev", "block", majorMinor))
+	if err != nil {
+		return majorMinor
+	}
+	return filepath.Base(link)
+}
+
+// truncateName keeps the first depth components of a cgroup path
+func truncateName(name string, depth int) string {
+	dirs := strings.Split(strings.Trim(name, "/"), "/")
+	if len(dirs) > depth {
+		dirs = dirs[:depth]
+	}
+	return "/" + strings.Join(dirs, "/")
+}
+
 func fileExists(filename string) bool {
 	info, err := os.Stat(filename)
 	if os.IsNotExist(err) {
@@ -301,12 +1265,21 @@ func fileExists(filename string) bool {
 	return !info.IsDir()
 }
 
-func sliceContains(s interface{}, v interface{}) bool {
-	slice := reflect.ValueOf(s)
-	for i := 0; i < slice.Len(); i++ {
-		if slice.Index(i).Interface() == v {
-			return true
-		}
+func newPidIndex() *pidIndex {
+	return &pidIndex{
+		pids: make(map[string][]int),
+		seen: make(map[int]bool),
+	}
+}
+
+// add records pid as a process of the cgroup name, each PID is only recorded once
+func (i *pidIndex) add(name string, pid int) {
+	if i.seen[pid] {
+		return
+	}
+	i.seen[pid] = true
+	if _, ok := i.pids[name]; !ok {
+		i.names = append(i.names, name)
 	}
-	return false
+	i.pids[name] = append(i.pids[name], pid)
 }
@@ -14,12 +14,18 @@
 package collector
 
 import (
+	"context"
+	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/promslog"
 )
 
@@ -30,8 +36,16 @@ func TestMain(m *testing.M) {
 	CgroupRoot = &fixture
 	procFixture := filepath.Join(fixture, "proc")
 	ProcRoot = &procFixture
+	sysFixture := filepath.Join(fixture, "sys")
+	SysRoot = &sysFixture
+	memoryStat := defMemoryStat
+	collectMemoryStat = &memoryStat
+	numaStat := defNumaStat
+	collectNumaStat = &numaStat
 	varTrue := true
 	collectProc = &varTrue
+	concurrency := 2
+	collectConcurrency = &concurrency
 
 	exitVal := m.Run()
 
@@ -64,7 +78,7 @@ func TestGetProcInfo(t *testing.T) {
 	level := promslog.NewLevel()
 	level.Set("debug")
 	logger := promslog.New(&promslog.Config{Level: level})
-	getProcInfo([]int{95521, 95525}, &metric, logger)
+	getProcInfo(context.Background(), nil, []int{95521, 95525}, &metric, logger)
 	if val, ok := metric.processExec["/bin/bash"]; !ok {
 		t.Errorf("Process /bin/bash not in metrics")
 		return
@@ -75,7 +89,7 @@ func TestGetProcInfo(t *testing.T) {
 	}
 	varLen := 6
 	collectProcMaxExec = &varLen
-	getProcInfo([]int{95521, 95525}, &metric, logger)
+	getProcInfo(context.Background(), nil, []int{95521, 95525}, &metric, logger)
 	if val, ok := metric.processExec["/bi...ash"]; !ok {
 		t.Errorf("Process /bin/bash not in metrics, found: %v", metric.processExec)
 		return
@@ -85,3 +99,469 @@ func TestGetProcInfo(t *testing.T) {
 		}
 	}
 }
+
+func TestGetQuotaCores(t *testing.T) {
+	if val := getQuotaCores(700000, 100000); val != 7 {
+		t.Errorf("Unexpected value for quota cores, got %v", val)
+	}
+	if val := getQuotaCores(50000, 100000); val != 0.5 {
+		t.Errorf("Unexpected value for quota cores, got %v", val)
+	}
+	if val := getQuotaCores(-1, 100000); val != -1 {
+		t.Errorf("Unexpected value for unlimited quota cores, got %v", val)
+	}
+	if val := getQuotaCores(100000, 0); val != -1 {
+		t.Errorf("Unexpected value for quota cores without period, got %v", val)
+	}
+}
+
+func TestGetCPUEfficiency(t *testing.T) {
+	level := promslog.NewLevel()
+	level.Set("debug")
+	logger := promslog.New(&promslog.Config{Level: level})
+	exporter := NewExporter(ConfigFromPaths([]string{"/slurm"}), logger, false)
+	now := time.Now()
+	metrics := []CgroupMetric{
+		{name: "/slurm/uid_20821/job_10", cpuTotal: 100, cpus: 2},
+		{name: "/slurm/uid_20821/job_11", cpuTotal: 50, cpuQuotaCores: 4},
+		{name: "/slurm/uid_20821/job_12", cpuTotal: 10},
+		{name: "/slurm/uid_20821/job_13", cpuTotal: 10, cpus: 1},
+		{name: "/slurm/uid_20821/job_14", cpuTotal: 10, cpus: 1},
+		{name: "/slurm/uid_20821/job_15", cpuTotal: 10, cpusEffective: 4, cpuQuotaCores: 2},
+	}
+	metrics[3].setError(reasonProcUnreadable)
+	metrics[4].setFailed(reasonStatFailed)
+	if val := exporter.getCPUEfficiency(metrics, now); len(val) != 0 {
+		t.Errorf("Unexpected efficiency on first collection, got %v", val)
+	}
+	metrics = []CgroupMetric{
+		{name: "/slurm/uid_20821/job_10", cpuTotal: 130, cpus: 2},
+		{name: "/slurm/uid_20821/job_11", cpuTotal: 80, cpuQuotaCores: 4},
+		{name: "/slurm/uid_20821/job_12", cpuTotal: 20},
+		{name: "/slurm/uid_20821/job_13", cpuTotal: 25, cpus: 1},
+		{name: "/slurm/uid_20821/job_14", cpuTotal: 25, cpus: 1},
+		{name: "/slurm/uid_20821/job_15", cpuTotal: 70, cpusEffective: 4, cpuQuotaCores: 2},
+	}
+	metrics[3].setError(reasonProcUnreadable)
+	efficiency := exporter.getCPUEfficiency(metrics, now.Add(30*time.Second))
+	if val, ok := efficiency["/slurm/uid_20821/job_10"]; !ok || val != 0.5 {
+		t.Errorf("Unexpected efficiency for job_10, got %v", val)
+	}
+	if val, ok := efficiency["/slurm/uid_20821/job_11"]; !ok || val != 0.25 {
+		t.Errorf("Unexpected efficiency for job_11, got %v", val)
+	}
+	if val, ok := efficiency["/slurm/uid_20821/job_12"]; ok {
+		t.Errorf("Unexpected efficiency for job_12 without allocated CPUs, got %v", val)
+	}
+	if val, ok := efficiency["/slurm/uid_20821/job_13"]; !ok || val != 0.5 {
+		t.Errorf("Unexpected efficiency for job_13 with unreadable process, got %v", val)
+	}
+	if val, ok := efficiency["/slurm/uid_20821/job_14"]; ok {
+		t.Errorf("Unexpected efficiency for job_14 without previous sample, got %v", val)
+	}
+	if val, ok := efficiency["/slurm/uid_20821/job_15"]; !ok || val != 0.5 {
+		t.Errorf("Unexpected efficiency for job_15 with effective CPUs, got %v", val)
+	}
+	metrics = []CgroupMetric{
+		{name: "/slurm/uid_20821/job_10", cpuTotal: 5, cpus: 2},
+	}
+	if val := exporter.getCPUEfficiency(metrics, now.Add(60*time.Second)); len(val) != 0 {
+		t.Errorf("Unexpected efficiency after counter reset, got %v", val)
+	}
+	if val := len(exporter.cpuSamples); val != 1 {
+		t.Errorf("Unexpected number of CPU samples, got %d expected 1", val)
+	}
+}
+
+func TestGetValue(t *testing.T) {
+	if _, err := getValue("/dne"); err == nil {
+		t.Errorf("Expected error with /dne but none given")
+	}
+	if _, err := getValue(filepath.Join(*CgroupRoot, "stat.invalid")); err == nil {
+		t.Errorf("Expected error with stat.invalid but none given")
+	}
+	if val, err := getValue(filepath.Join(*CgroupRoot, "user.slice/user-20821.slice/memory.high")); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	} else if val != math.MaxUint64 {
+		t.Errorf("Unexpected value for memory.high, got %v", val)
+	}
+	if val, err := getValue(filepath.Join(*CgroupRoot, "user.slice/user-20821.slice/memory.max")); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	} else if val != 2147483648 {
+		t.Errorf("Unexpected value for memory.max, got %v", val)
+	}
+}
+
+func TestGetBlockDevice(t *testing.T) {
+	if val := getBlockDevice("8:0"); val != "sda" {
+		t.Errorf("Unexpected device for 8:0, got %v", val)
+	}
+	if val := getBlockDevice("253:0"); val != "dm-0" {
+		t.Errorf("Unexpected device for 253:0, got %v", val)
+	}
+	if val := getBlockDevice("253:1"); val != "253:1" {
+		t.Errorf("Unexpected device for 253:1, got %v", val)
+	}
+}
+
+func TestFilterMemoryStat(t *testing.T) {
+	stats := map[string]float64{"anon": 1, "file": 2, "pgfault": 3}
+	level := promslog.NewLevel()
+	level.Set("debug")
+	logger := promslog.New(&promslog.Config{Level: level})
+	keys := "anon,pgfault"
+	collectMemoryStat = &keys
+	exporter := NewExporter(ConfigFromPaths([]string{"/user.slice"}), logger, true)
+	expected := map[string]float64{"anon": 1, "pgfault": 3}
+	if val := exporter.filterMemoryStat(stats); !reflect.DeepEqual(val, expected) {
+		t.Errorf("Unexpected memory stats, expected %v got %v", expected, val)
+	}
+	all := "all"
+	collectMemoryStat = &all
+	exporter = NewExporter(ConfigFromPaths([]string{"/user.slice"}), logger, true)
+	if val := exporter.filterMemoryStat(stats); !reflect.DeepEqual(val, stats) {
+		t.Errorf("Unexpected memory stats, expected %v got %v", stats, val)
+	}
+	memoryStat := defMemoryStat
+	collectMemoryStat = &memoryStat
+}
+
+func TestFilterNumaStat(t *testing.T) {
+	numa := []numaStat{{node: "0", kind: "anon"}, {node: "0", kind: "file"}, {node: "0", kind: "pagetables"}}
+	keys := "anon,file"
+	collectNumaStat = &keys
+	// memory.stat keys do not limit NUMA types
+	memoryStatKeys := ""
+	collectMemoryStat = &memoryStatKeys
+	for _, cgroupv2 := range []bool{false, true} {
+		exporter := NewExporter(ConfigFromPaths([]string{"/user.slice"}), promslog.NewNopLogger(), cgroupv2)
+		if val := exporter.filterNumaStat(numa); !reflect.DeepEqual(val, numa[:2]) {
+			t.Errorf("Unexpected numa stats for cgroupv2=%v, got %v", cgroupv2, val)
+		}
+	}
+	all := "all"
+	collectNumaStat = &all
+	exporter := NewExporter(ConfigFromPaths([]string{"/user.slice"}), promslog.NewNopLogger(), false)
+	if val := exporter.filterNumaStat(numa); !reflect.DeepEqual(val, numa) {
+		t.Errorf("Unexpected numa stats with all types, got %v", val)
+	}
+	numaStat := defNumaStat
+	collectNumaStat = &numaStat
+	memoryStat := defMemoryStat
+	collectMemoryStat = &memoryStat
+}
+
+func TestCollectLoop(t *testing.T) {
+	varFalse := false
+	collectProc = &varFalse
+	level := promslog.NewLevel()
+	level.Set("debug")
+	logger := promslog.New(&promslog.Config{Level: level})
+	exporter := NewExporter(ConfigFromPaths([]string{"/user.slice"}), logger, false)
+	exporter.collectInterval = 10 * time.Millisecond
+	done := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		exporter.collectLoop(done)
+	}()
+	for i := 0; i < 100; i++ {
+		exporter.snapshotLock.RLock()
+		s := exporter.snapshot
+		exporter.snapshotLock.RUnlock()
+		if s != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+	if exporter.snapshot == nil {
+		t.Fatalf("Background collection did not produce a snapshot")
+	}
+	if val := len(exporter.snapshot.metrics); val != 1 {
+		t.Errorf("Unexpected number of metrics in snapshot, got %d expected 1", val)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(exporter)
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Unexpected error gathering metrics: %s", err)
+	}
+	var found bool
+	for _, mf := range mfs {
+		if mf.GetName() == "cgroup_exporter_snapshot_age_seconds" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Metric cgroup_exporter_snapshot_age_seconds not found")
+	}
+}
+
+func TestCollectShared(t *testing.T) {
+	varFalse := false
+	collectProc = &varFalse
+	exporter := NewExporter(ConfigFromPaths([]string{"/user.slice"}), promslog.NewNopLogger(), false)
+	c := &inflight{done: make(chan struct{})}
+	exporter.inflight = c
+	result := make(chan *snapshot)
+	go func() {
+		result <- exporter.collectShared(context.Background())
+	}()
+	for exporter.coalescedTotal.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	c.s = &snapshot{}
+	close(c.done)
+	if s := <-result; s != c.s {
+		t.Errorf("Coalesced scrape did not return the in progress snapshot")
+	}
+	exporter.inflight = nil
+	if s := exporter.collectShared(context.Background()); len(s.metrics) != 1 {
+		t.Errorf("Unexpected number of metrics, got %d expected 1", len(s.metrics))
+	}
+	if exporter.inflight != nil {
+		t.Errorf("In progress collection not cleared")
+	}
+	if val := exporter.coalescedTotal.Load(); val != 1 {
+		t.Errorf("Unexpected value for coalesced scrapes, got %d expected 1", val)
+	}
+	// Waiting scrapes stop at their own deadline
+	c = &inflight{done: make(chan struct{})}
+	exporter.inflight = c
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	s := exporter.collectShared(ctx)
+	close(c.done)
+	if val := len(s.metrics); val != 1 {
+		t.Fatalf("Unexpected number of metrics, got %d expected 1", val)
+	}
+	if m := s.metrics[0]; m.name != "/user.slice" || !m.failed || m.errReason != reasonTimeout {
+		t.Errorf("Unexpected metric for scrape that stopped waiting: %v", m)
+	}
+	if val := exporter.errorCount[reasonTimeout]; val != 0 {
+		t.Errorf("Unexpected timeout errors counted for scrape that stopped waiting, got %v", val)
+	}
+	// Collection is not cut short when the scrape that started it is cancelled
+	exporter.inflight = nil
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	s = exporter.collectShared(ctx)
+	if val := len(s.metrics); val != 1 {
+		t.Fatalf("Unexpected number of metrics, got %d expected 1", val)
+	}
+	if val := s.metrics[0].err; val {
+		t.Errorf("Unexpected error for collection started by a cancelled scrape: %v", s.metrics[0])
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	varFalse := false
+	collectProc = &varFalse
+	exporter := NewExporter(ConfigFromPaths([]string{"/user.slice"}), promslog.NewNopLogger(), false)
+	exporter.pidErrorCount["/user.slice"] = 1
+	exporter.SetConfig(ConfigFromPaths([]string{"/dne"}))
+	s := exporter.collect(context.Background())
+	if _, ok := exporter.pidErrorCount["/user.slice"]; ok {
+		t.Errorf("PID errors of removed path not cleared")
+	}
+	if val := len(s.paths); val != 1 {
+		t.Fatalf("Unexpected number of paths, got %d expected 1", val)
+	}
+	if val := s.paths[0].path; val != "/dne" {
+		t.Errorf("Unexpected path, got %s expected /dne", val)
+	}
+	if val := s.metrics[0].err; val != true {
+		t.Errorf("Expected collect error for /dne")
+	}
+}
+
+func TestExpandPaths(t *testing.T) {
+	config := &Config{Paths: []PathConfig{
+		{Path: "/user.slice/*"},
+		{Path: "/user.slice/user-20821.slice"},
+		{Path: "~/user\\.slice/user-[0-9]+\\.slice"},
+		{Path: "/*lurm"},
+		{Path: "~/dne/.*"},
+	}}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	exporter := NewExporter(config, promslog.NewNopLogger(), false)
+	paths := exporter.expandPaths(config.Paths)
+	var names []string
+	for _, p := range paths {
+		names = append(names, p.Path)
+	}
+	expected := []string{"/user.slice/user-20821.slice", "/slurm"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Unexpected paths, got %v expected %v", names, expected)
+	}
+	exporter = NewExporter(config, promslog.NewNopLogger(), true)
+	paths = exporter.expandPaths([]PathConfig{config.Paths[2]})
+	if val := len(paths); val != 1 {
+		t.Fatalf("Unexpected number of paths, got %d expected 1", val)
+	}
+	if val := paths[0].Path; val != "/user.slice/user-20821.slice" {
+		t.Errorf("Unexpected path, got %s", val)
+	}
+}
+
+func TestExpandPathsOverlap(t *testing.T) {
+	varFalse := false
+	collectProc = &varFalse
+	config := ConfigFromPaths([]string{"/user.slice", "/user.slice/*"})
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	exporter := NewExporter(config, promslog.NewNopLogger(), false)
+	if val := exporter.expandPaths(config.Paths); len(val) != 1 || val[0].Path != "/user.slice" {
+		t.Errorf("Unexpected paths, got %v", val)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(exporter)
+	if _, err := registry.Gather(); err != nil {
+		t.Errorf("Unexpected error gathering metrics: %s", err)
+	}
+	// Plain paths are compared by the cgroup they read
+	config = ConfigFromPaths([]string{"/slurm", "/system.slice/*"})
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	exporter = NewExporter(config, promslog.NewNopLogger(), true)
+	if val := exporter.expandPaths(config.Paths); len(val) != 1 || val[0].Path != "/slurm" {
+		t.Errorf("Unexpected paths, got %v", val)
+	}
+}
+
+func TestGetProcInfoTimeout(t *testing.T) {
+	metric := CgroupMetric{name: "/test"}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	getProcInfo(ctx, nil, []int{95521, 95525}, &metric, promslog.NewNopLogger())
+	if !metric.err {
+		t.Errorf("Expected error when context is done")
+	}
+	if val := metric.errReason; val != "timeout" {
+		t.Errorf("Unexpected value for errReason, got %v", val)
+	}
+}
+
+func TestGetProcInfoUnreadable(t *testing.T) {
+	logger := promslog.NewNopLogger()
+	metric := CgroupMetric{name: "/test"}
+	// Processes that exit before they are read are not errors
+	getProcInfo(context.Background(), nil, []int{95521, 1}, &metric, logger)
+	if metric.err {
+		t.Errorf("Unexpected error for process that does not exist: %s", metric.errReason)
+	}
+	procRoot := *ProcRoot
+	dne := "/dne"
+	ProcRoot = &dne
+	defer func() { ProcRoot = &procRoot }()
+	metric = CgroupMetric{name: "/test"}
+	getProcInfo(context.Background(), nil, []int{95521}, &metric, logger)
+	if val := metric.errReason; val != "proc_unreadable" {
+		t.Errorf("Unexpected value for errReason, got %v", val)
+	}
+}
+
+func TestGetMetricsTimeout(t *testing.T) {
+	exporter := NewExporter(ConfigFromPaths([]string{"/user.slice"}), promslog.NewNopLogger(), false)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	release := make(chan struct{})
+	defer close(release)
+	metrics := exporter.getMetrics(ctx, []string{"/fast", "/slow"}, func(n string) (CgroupMetric, bool) {
+		if n == "/slow" {
+			<-release
+		}
+		return CgroupMetric{name: n, cpuTotal: 1}, true
+	})
+	if val := len(metrics); val != 2 {
+		t.Fatalf("Unexpected number of metrics, got %d expected 2", val)
+	}
+	for _, m := range metrics {
+		switch m.name {
+		case "/fast":
+			if m.err || m.cpuTotal != 1 {
+				t.Errorf("Unexpected metric for completed cgroup: %v", m)
+			}
+		case "/slow":
+			if !m.err || !m.failed {
+				t.Errorf("Expected failed metric for cgroup that did not complete")
+			}
+		default:
+			t.Errorf("Unexpected cgroup %s", m.name)
+		}
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	wait := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "wait", Buckets: []float64{10}})
+	pool := newWorkerPool(1, wait)
+	release, err := pool.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := pool.acquire(ctx); err == nil {
+		t.Errorf("Expected error acquiring worker from full pool")
+	}
+	release()
+	release()
+	release, err = pool.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error after release: %s", err)
+	}
+	release()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(wait)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Unexpected error gathering metrics: %s", err)
+	}
+	histogram := families[0].GetMetric()[0].GetHistogram()
+	if val := histogram.GetSampleCount(); val != 2 {
+		t.Errorf("Unexpected wait count, got %d expected 2", val)
+	}
+	if val := histogram.GetBucket()[0].GetCumulativeCount(); val != 2 {
+		t.Errorf("Unexpected value for largest bucket, got %d expected 2", val)
+	}
+	unlimited := newWorkerPool(0, wait)
+	for i := 0; i < 3; i++ {
+		if _, err := unlimited.acquire(context.Background()); err != nil {
+			t.Errorf("Unexpected error from unlimited pool: %s", err)
+		}
+	}
+}
+
+func TestPidIndex(t *testing.T) {
+	index := newPidIndex()
+	index.add("/b", 1)
+	index.add("/a", 2)
+	index.add("/b", 3)
+	index.add("/b", 1)
+	if val := index.names; !reflect.DeepEqual(val, []string{"/b", "/a"}) {
+		t.Errorf("Unexpected names, got %v", val)
+	}
+	if val := index.pids["/b"]; !reflect.DeepEqual(val, []int{1, 3}) {
+		t.Errorf("Unexpected PIDs, got %v", val)
+	}
+}
+
+func BenchmarkPidIndex(b *testing.B) {
+	names := make([]string, 1000)
+	for i := range names {
+		names[i] = fmt.Sprintf("/slurm/uid_1000/job_%d", i)
+	}
+	for i := 0; i < b.N; i++ {
+		index := newPidIndex()
+		for pid := 0; pid < 100000; pid++ {
+			index.add(names[pid%len(names)], pid)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"go.yaml.in/yaml/v2"
+)
+
+const (
+	groupCPU      = "cpu"
+	groupMemory   = "memory"
+	groupIO       = "io"
+	groupPids     = "pids"
+	groupHugetlb  = "hugetlb"
+	groupNuma     = "numa"
+	groupPressure = "pressure"
+	// Default cgroup v2 group used for the /slurm path
+	defSlurmGroup = "/system.slice/slurmstepd.scope"
+)
+
+var metricGroups = []string{groupCPU, groupMemory, groupIO, groupPids, groupHugetlb, groupNuma, groupPressure}
+
+type Config struct {
+	Paths []PathConfig `yaml:"paths"`
+}
+
+// PathConfig configures the collection of one cgroup path
+type PathConfig struct {
+	// Path is the configured path, used as the path label of exporter metrics.
+	// A path containing *, ? or [ is a glob and a path starting with ~ is a regex,
+	// both are expanded to the matching cgroups at each collection
+	Path string `yaml:"path"`
+	// Group is the cgroup to read relative to the cgroup root, defaults to Path
+	Group string `yaml:"group"`
+	// Depth is the number of path components kept in cgroup names
+	Depth int `yaml:"depth"`
+	// RelativeDepth is the number of path components kept below the cgroup read for the path
+	RelativeDepth int `yaml:"relative_depth"`
+	// StopAt is a regex, cgroup names end at the first component below the cgroup read for the path that matches.
+	// When Depth, RelativeDepth and StopAt are not set the built in rules are used
+	StopAt string `yaml:"stop_at"`
+	// Rename rewrites cgroup names before they are used as the cgroup label
+	Rename *RenameConfig `yaml:"rename"`
+	// Include is a regex of cgroup names to collect, overrides --collect.include
+	Include string `yaml:"include"`
+	// Exclude is a regex of cgroup names to skip, overrides --collect.exclude
+	Exclude string `yaml:"exclude"`
+	// Collect is the list of metric groups to collect, empty collects all groups
+	Collect []string `yaml:"collect"`
+	// Proc overrides --collect.proc for this path
+	Proc *bool `yaml:"proc"`
+
+	groups  map[string]bool
+	stopAt  *regexp.Regexp
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+	glob    bool
+	regex   *regexp.Regexp
+	// Directory the regex walk starts from, the directory part of the literal regex prefix
+	walkRoot string
+}
+
+type RenameConfig struct {
+	Regex       string `yaml:"regex"`
+	Replacement string `yaml:"replacement"`
+
+	regex *regexp.Regexp
+}
+
+// LoadConfig reads and validates a YAML configuration file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("error validating %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// ConfigFromPaths returns the configuration for paths given with --config.paths
+func ConfigFromPaths(paths []string) *Config {
+	config := &Config{}
+	for _, path := range paths {
+		config.Paths = append(config.Paths, PathConfig{Path: path})
+	}
+	return config
+}
+
+// Validate checks the configuration and prepares it for use
+func (c *Config) Validate() error {
+	if len(c.Paths) == 0 {
+		return fmt.Errorf("no paths configured")
+	}
+	seen := make(map[string]bool)
+	for i := range c.Paths {
+		p := &c.Paths[i]
+		if !strings.HasPrefix(strings.TrimPrefix(p.Path, "~"), "/") {
+			return fmt.Errorf("path %q must be absolute", p.Path)
+		}
+		if seen[p.Path] {
+			return fmt.Errorf("path %s is configured more than once", p.Path)
+		}
+		seen[p.Path] = true
+		if p.Group != "" && !strings.HasPrefix(p.Group, "/") {
+			return fmt.Errorf("path %s: group %q must be absolute", p.Path, p.Group)
+		}
+		if err := p.compilePattern(); err != nil {
+			return fmt.Errorf("path %s: %w", p.Path, err)
+		}
+		if p.pattern() && p.Group != "" {
+			return fmt.Errorf("path %s: group can not be set for a glob or regex path", p.Path)
+		}
+		if p.Depth < 0 || p.RelativeDepth < 0 {
+			return fmt.Errorf("path %s: depth must not be negative", p.Path)
+		}
+		aggregations := 0
+		for _, set := range []bool{p.Depth > 0, p.RelativeDepth > 0, p.StopAt != ""} {
+			if set {
+				aggregations++
+			}
+		}
+		if aggregations > 1 {
+			return fmt.Errorf("path %s: only one of depth, relative_depth and stop_at can be set", p.Path)
+		}
+		p.stopAt = nil
+		if p.StopAt != "" {
+			regex, err := regexp.Compile("^(?:" + p.StopAt + ")$")
+			if err != nil {
+				return fmt.Errorf("path %s: invalid stop_at regex: %w", p.Path, err)
+			}
+			p.stopAt = regex
+		}
+		if p.Rename != nil {
+			regex, err := regexp.Compile(p.Rename.Regex)
+			if err != nil {
+				return fmt.Errorf("path %s: invalid rename regex: %w", p.Path, err)
+			}
+			p.Rename.regex = regex
+		}
+		var err error
+		if p.include, err = compileFilter(p.Include, *collectInclude); err != nil {
+			return fmt.Errorf("path %s: invalid include regex: %w", p.Path, err)
+		}
+		if p.exclude, err = compileFilter(p.Exclude, *collectExclude); err != nil {
+			return fmt.Errorf("path %s: invalid exclude regex: %w", p.Path, err)
+		}
+		p.groups = nil
+		if len(p.Collect) > 0 {
+			p.groups = make(map[string]bool)
+			for _, group := range p.Collect {
+				if !slices.Contains(metricGroups, group) {
+					return fmt.Errorf("path %s: unknown metric group %q, must be one of %s", p.Path, group, strings.Join(metricGroups, ","))
+				}
+				p.groups[group] = true
+			}
+		}
+	}
+	return nil
+}
+
+// compileFilter compiles a cgroup name filter matched against the whole name, def is used when expr is empty
+func compileFilter(expr string, def string) (*regexp.Regexp, error) {
+	if expr == "" {
+		expr = def
+	}
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// compilePattern detects glob and regex paths and prepares them for expansion
+func (p *PathConfig) compilePattern() error {
+	p.glob = false
+	p.regex = nil
+	if pattern, ok := strings.CutPrefix(p.Path, "~"); ok {
+		regex, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid path regex: %w", err)
+		}
+		p.regex = regex
+		// Only directories under the literal prefix can match
+		prefix, _ := regexp.MustCompile(pattern).LiteralPrefix()
+		p.walkRoot = filepath.Dir(prefix + "x")
+		return nil
+	}
+	if strings.ContainsAny(p.Path, "*?[") {
+		if _, err := filepath.Match(p.Path, ""); err != nil {
+			return fmt.Errorf("invalid path glob: %w", err)
+		}
+		p.glob = true
+	}
+	return nil
+}
+
+// pattern returns if the path is a glob or regex
+func (p *PathConfig) pattern() bool {
+	return p.glob || p.regex != nil
+}
+
+// expand returns the cgroups under root matched by a glob or regex path
+func (p *PathConfig) expand(root string) ([]string, error) {
+	var paths []string
+	if p.glob {
+		matches, err := filepath.Glob(filepath.Join(root, p.Path))
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			if info, err := os.Stat(match); err != nil || !info.IsDir() {
+				continue
+			}
+			paths = append(paths, cgroupPath(root, match))
+		}
+		return paths, nil
+	}
+	start := filepath.Join(root, p.walkRoot)
+	err := filepath.WalkDir(start, func(dir string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Cgroups removed during the walk are skipped
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		name := cgroupPath(root, dir)
+		if p.regex.MatchString(name) {
+			paths = append(paths, name)
+			// Cgroups below a match are collected as part of the match
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// cgroupPath returns the path of dir relative to the cgroup root
+func cgroupPath(root string, dir string) string {
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(dir, root), "/")
+}
+
+// group returns the cgroup read for the path
+func (p *PathConfig) group(cgroupv2 bool) string {
+	if p.Group != "" {
+		return p.Group
+	}
+	// Allows previous cgroupv1 path to work as default for cgroupv2 path
+	if cgroupv2 && p.Path == "/slurm" {
+		return defSlurmGroup
+	}
+	return p.Path
+}
+
+// aggregate returns the cgroup name that the cgroup dir is collected as, where group is the cgroup read for the path.
+// The returned bool is false when no aggregation is configured and the built in rules apply.
+func (p *PathConfig) aggregate(dir string, group string) (string, bool) {
+	switch {
+	case p.Depth > 0:
+		return truncateName(dir, p.Depth), true
+	case p.RelativeDepth > 0:
+		return truncateName(dir, nameDepth(group)+p.RelativeDepth), true
+	case p.stopAt != nil:
+		dirs := strings.Split(strings.Trim(dir, "/"), "/")
+		for i := nameDepth(group); i < len(dirs); i++ {
+			if p.stopAt.MatchString(dirs[i]) {
+				return "/" + strings.Join(dirs[:i+1], "/"), true
+			}
+		}
+		return dir, true
+	}
+	return dir, false
+}
+
+// nameDepth returns the number of path components in a cgroup name
+func nameDepth(name string) int {
+	name = strings.Trim(name, "/")
+	if name == "" {
+		return 0
+	}
+	return len(strings.Split(name, "/"))
+}
+
+// collects returns if a metric group is collected for the path, all groups are collected when none are configured
+func (p *PathConfig) collects(group string) bool {
+	return p.groups == nil || p.groups[group]
+}
+
+// proc returns if process information is collected for the path
+func (p *PathConfig) proc() bool {
+	if p.Proc != nil {
+		return *p.Proc
+	}
+	return *collectProc
+}
+
+// filter returns the cgroup names that match the include regex and do not match the exclude regex
+func (p *PathConfig) filter(names []string) []string {
+	if p.include == nil && p.exclude == nil {
+		return names
+	}
+	var filtered []string
+	for _, name := range names {
+		if p.include != nil && !p.include.MatchString(name) {
+			continue
+		}
+		if p.exclude != nil && p.exclude.MatchString(name) {
+			continue
+		}
+		filtered = append(filtered, name)
+	}
+	return filtered
+}
+
+// apply renames metrics and sets the metric groups to collect
+func (p *PathConfig) apply(metrics []CgroupMetric) {
+	for i := range metrics {
+		metrics[i].name = p.rename(metrics[i].name)
+		metrics[i].groups = p.groups
+	}
+}
+
+// rename returns the cgroup label for a cgroup name
+func (p *PathConfig) rename(name string) string {
+	if p.Rename == nil || p.Rename.regex == nil {
+		return name
+	}
+	return p.Rename.regex.ReplaceAllString(name, p.Rename.Replacement)
+}
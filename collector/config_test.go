@@ -0,0 +1,328 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/promslog"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+paths:
+  - path: /slurm
+    group: /system.slice/slurmstepd.scope
+    depth: 3
+    rename:
+      regex: '^/system.slice/slurmstepd.scope/(.*)$'
+      replacement: '/slurm/$1'
+    collect: [cpu, memory]
+    proc: false
+  - path: /user.slice
+`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if val := len(config.Paths); val != 2 {
+		t.Fatalf("Unexpected number of paths, got %d expected 2", val)
+	}
+	p := config.Paths[0]
+	if val := p.group(true); val != "/system.slice/slurmstepd.scope" {
+		t.Errorf("Unexpected group, got %s", val)
+	}
+	if val := p.Depth; val != 3 {
+		t.Errorf("Unexpected depth, got %d", val)
+	}
+	if val := p.rename("/system.slice/slurmstepd.scope/job_4"); val != "/slurm/job_4" {
+		t.Errorf("Unexpected rename, got %s", val)
+	}
+	if val := p.proc(); val != false {
+		t.Errorf("Unexpected value for proc, got %v", val)
+	}
+	m := CgroupMetric{groups: p.groups}
+	if !m.collects("cpu") || m.collects("io") {
+		t.Errorf("Unexpected metric groups, got %v", p.groups)
+	}
+	u := config.Paths[1]
+	if val := u.group(true); val != "/user.slice" {
+		t.Errorf("Unexpected group, got %s", val)
+	}
+	if val := u.proc(); val != *collectProc {
+		t.Errorf("Unexpected value for proc, got %v", val)
+	}
+	if val := u.rename("/user.slice/user-1000.slice"); val != "/user.slice/user-1000.slice" {
+		t.Errorf("Unexpected rename, got %s", val)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := map[string]string{
+		"unknown key":     "paths:\n  - path: /slurm\n    foo: bar\n",
+		"no paths":        "paths: []\n",
+		"relative path":   "paths:\n  - path: slurm\n",
+		"duplicate path":  "paths:\n  - path: /slurm\n  - path: /slurm\n",
+		"relative group":  "paths:\n  - path: /slurm\n    group: slurm\n",
+		"negative depth":  "paths:\n  - path: /slurm\n    depth: -1\n",
+		"invalid rename":  "paths:\n  - path: /slurm\n    rename:\n      regex: '('\n",
+		"unknown collect": "paths:\n  - path: /slurm\n    collect: [foo]\n",
+		"invalid glob":    "paths:\n  - path: /system.slice/[\n",
+		"invalid regex":   "paths:\n  - path: '~/system.slice/('\n",
+		"relative regex":  "paths:\n  - path: '~system.slice/.*'\n",
+		"pattern group":   "paths:\n  - path: /system.slice/*\n    group: /slurm\n",
+		"negative rdepth": "paths:\n  - path: /slurm\n    relative_depth: -1\n",
+		"invalid stop_at": "paths:\n  - path: /slurm\n    stop_at: '('\n",
+		"multiple depths": "paths:\n  - path: /slurm\n    depth: 3\n    stop_at: 'job_.*'\n",
+		"invalid include": "paths:\n  - path: /slurm\n    include: '('\n",
+		"invalid exclude": "paths:\n  - path: /slurm\n    exclude: '('\n",
+	}
+	for name, content := range tests {
+		if _, err := LoadConfig(writeConfig(t, content)); err == nil {
+			t.Errorf("Expected error for %s", name)
+		}
+	}
+	if _, err := LoadConfig("/dne"); err == nil {
+		t.Errorf("Expected error for file that does not exist")
+	}
+}
+
+func TestGroupDefaults(t *testing.T) {
+	p := PathConfig{Path: "/slurm"}
+	if val := p.group(false); val != "/slurm" {
+		t.Errorf("Unexpected cgroup v1 group, got %s", val)
+	}
+	if val := p.group(true); val != "/system.slice/slurmstepd.scope" {
+		t.Errorf("Unexpected cgroup v2 group, got %s", val)
+	}
+}
+
+func TestCollectConfig(t *testing.T) {
+	varFalse := false
+	config := &Config{Paths: []PathConfig{{
+		Path:    "/slurm",
+		Depth:   3,
+		Rename:  &RenameConfig{Regex: "^/system.slice/slurmstepd.scope/(.*)$", Replacement: "/slurm/$1"},
+		Collect: []string{"cpu"},
+		Proc:    &varFalse,
+	}}}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	exporter := NewExporter(config, promslog.NewNopLogger(), true)
+	metrics, _, err := exporter.collectv2(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if val := len(metrics); val != 1 {
+		t.Fatalf("Unexpected number of metrics, got %d expected 1", val)
+	}
+	if val := metrics[0].name; val != "/slurm/job_4" {
+		t.Errorf("Unexpected value for name, got %s", val)
+	}
+	if val := metrics[0].processExec; val != nil {
+		t.Errorf("Unexpected process info when proc is disabled, got %v", val)
+	}
+	if !metrics[0].collects("cpu") || metrics[0].collects("memory") {
+		t.Errorf("Unexpected metric groups, got %v", metrics[0].groups)
+	}
+}
+
+func TestCollectConfigSkipsReads(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "test.slice", "test.service")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"cgroup.procs": "1\n",
+		"cpu.stat":     "usage_usec 2000000\nuser_usec 1500000\nsystem_usec 500000\n",
+	}
+	for file, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cgroupRoot := *CgroupRoot
+	CgroupRoot = &root
+	defer func() { CgroupRoot = &cgroupRoot }()
+	varFalse := false
+	config := &Config{Paths: []PathConfig{{Path: "/test.slice", Collect: []string{"cpu"}, Proc: &varFalse}}}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	exporter := NewExporter(config, promslog.NewNopLogger(), true)
+	metrics, _, err := exporter.collectv2(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if val := len(metrics); val != 1 {
+		t.Fatalf("Unexpected number of metrics, got %d expected 1", val)
+	}
+	// memory.stat is not read when memory is not collected
+	if val := metrics[0].err; val {
+		t.Errorf("Unexpected error without memory.stat, reason %s", metrics[0].errReason)
+	}
+	if val := metrics[0].cpuTotal; val != 2 {
+		t.Errorf("Unexpected value for cpuTotal, got %v", val)
+	}
+	config.Paths[0].Collect = nil
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	metrics, _, _ = exporter.collectv2(context.Background())
+	if val := metrics[0].errReason; val != reasonMemoryStatMissing {
+		t.Errorf("Unexpected error reason collecting all groups, got %q", val)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	config := &Config{Paths: []PathConfig{{Path: "/system.slice", Include: "/system.slice/.*", Exclude: ".*/(sshd|crond).service"}}}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	names := []string{"/system.slice/sshd.service", "/system.slice/slurmd.service", "/system.slice/crond.service", "/user.slice/user-0.slice", "/system.slice/sshd.service.d"}
+	expected := []string{"/system.slice/slurmd.service", "/system.slice/sshd.service.d"}
+	if val := config.Paths[0].filter(names); !reflect.DeepEqual(val, expected) {
+		t.Errorf("Unexpected names, expected %v got %v", expected, val)
+	}
+	exclude := "/user.slice/user-20821.slice"
+	collectExclude = &exclude
+	defer func() {
+		empty := ""
+		collectExclude = &empty
+	}()
+	config = ConfigFromPaths([]string{"/user.slice"})
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	exporter := NewExporter(config, promslog.NewNopLogger(), false)
+	metrics, stats, err := exporter.collectv1(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if val := len(metrics); val != 0 {
+		t.Errorf("Unexpected number of metrics, got %d expected 0", val)
+	}
+	if val := stats[0].cgroups; val != 1 {
+		t.Errorf("Unexpected number of discovered cgroups, got %d expected 1", val)
+	}
+	config = &Config{Paths: []PathConfig{{Path: "/user.slice", Exclude: "/user.slice/user-0.slice"}}}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	exporter = NewExporter(config, promslog.NewNopLogger(), false)
+	metrics, _, err = exporter.collectv1(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if val := len(metrics); val != 1 {
+		t.Errorf("Unexpected number of metrics with path exclude, got %d expected 1", val)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	tests := []struct {
+		path     PathConfig
+		dir      string
+		expected string
+		ok       bool
+	}{
+		{PathConfig{Path: "/system.slice", Depth: 2}, "/system.slice/sshd.service/sub", "/system.slice/sshd.service", true},
+		{PathConfig{Path: "/system.slice", RelativeDepth: 1}, "/system.slice/sshd.service/sub", "/system.slice/sshd.service", true},
+		{PathConfig{Path: "/system.slice/slurmstepd.scope", RelativeDepth: 1}, "/system.slice/slurmstepd.scope/job_4/step_0", "/system.slice/slurmstepd.scope/job_4", true},
+		{PathConfig{Path: "/", RelativeDepth: 1}, "/user.slice/user-20821.slice", "/user.slice", true},
+		{PathConfig{Path: "/slurm", StopAt: "job_[0-9]+"}, "/slurm/uid_20821/job_10/step_0/task_0", "/slurm/uid_20821/job_10", true},
+		{PathConfig{Path: "/slurm", StopAt: "job_[0-9]+"}, "/slurm/uid_20821", "/slurm/uid_20821", true},
+		{PathConfig{Path: "/job_1", StopAt: "job_[0-9]+"}, "/job_1/job_2/step_0", "/job_1/job_2", true},
+		{PathConfig{Path: "/user.slice"}, "/user.slice/user-20821.slice/session-1.scope", "/user.slice/user-20821.slice/session-1.scope", false},
+	}
+	for _, test := range tests {
+		config := &Config{Paths: []PathConfig{test.path}}
+		if err := config.Validate(); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		p := config.Paths[0]
+		name, ok := p.aggregate(test.dir, p.group(false))
+		if name != test.expected || ok != test.ok {
+			t.Errorf("Unexpected name for %s with %+v, got %s %v expected %s %v", test.dir, test.path, name, ok, test.expected, test.ok)
+		}
+	}
+}
+
+func TestAggregateCollect(t *testing.T) {
+	config := &Config{Paths: []PathConfig{
+		{Path: "/user.slice", RelativeDepth: 2},
+		{Path: "/slurm", StopAt: "job_[0-9]+"},
+	}}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	exporter := NewExporter(config, promslog.NewNopLogger(), true)
+	metrics, _, err := exporter.collectv2(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var names []string
+	for _, m := range metrics {
+		names = append(names, m.name)
+	}
+	slices.Sort(names)
+	expected := []string{
+		"/system.slice/slurmstepd.scope/job_4",
+		"/user.slice/user-20821.slice/session-133.scope",
+		"/user.slice/user-20821.slice/session-157.scope",
+		"/user.slice/user-20821.slice/user@20821.service",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Unexpected names, expected %v got %v", expected, names)
+	}
+}
+
+func TestRenameCollision(t *testing.T) {
+	varFalse := false
+	config := &Config{Paths: []PathConfig{{
+		Path:          "/user.slice",
+		RelativeDepth: 2,
+		Rename:        &RenameConfig{Regex: ".*", Replacement: "/user"},
+		Proc:          &varFalse,
+	}}}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	exporter := NewExporter(config, promslog.NewNopLogger(), true)
+	s := exporter.collect(context.Background())
+	if val := len(s.metrics); val != 1 {
+		t.Errorf("Unexpected number of metrics, got %d expected 1", val)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(exporter)
+	if _, err := registry.Gather(); err != nil {
+		t.Errorf("Unexpected error gathering metrics: %s", err)
+	}
+}